@@ -0,0 +1,99 @@
+package go_sknn
+
+import (
+	"cmp"
+	"slices"
+	"time"
+
+	"github.com/golang/geo/s2"
+)
+
+// Builder collects values and builds an index from them at once. Unlike adding the values with AddValue,
+// no nodes are split during the build: the values are sorted by their cell and every node is created
+// with its final values, which makes the build faster and the resulting tree compact.
+// The resulting index has the same structure as an index with the same values added one by one.
+//
+// A Builder must not be used concurrently.
+type Builder[T any] struct {
+	precision int
+	opts      []Option[T]
+	// knn is the empty index configured with the options, which is filled by Build.
+	knn    *KNN[T]
+	values map[string]*Value[T]
+}
+
+// NewBuilder creates a builder for an index with the given precision and options.
+// It returns an error if the precision or an option is invalid.
+func NewBuilder[T any](precision int, opts ...Option[T]) (*Builder[T], error) {
+	knn, err := NewKNN[T](precision, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Builder[T]{precision: precision, opts: opts, knn: knn, values: make(map[string]*Value[T])}, nil
+}
+
+// Add adds a value to the index which is built. If a value with the same id was added before, it is replaced.
+// The function will panic if the latitude or longitude are out of bounds.
+func (b *Builder[T]) Add(id string, value T, lat float64, long float64) {
+	if err := validateCoordinates(lat, long); err != nil {
+		panic(err.Error())
+	}
+	b.add(id, value, lat, long, time.Now())
+}
+
+// add adds a value with the time it was added to the index. The coordinates must be valid.
+func (b *Builder[T]) add(id string, value T, lat float64, long float64, addedAt time.Time) {
+	cellID := s2.CellIDFromLatLng(s2.LatLngFromDegrees(lat, long))
+	b.values[id] = &Value[T]{key: id, value: b.knn.internPayload(value), cell: cellID, addedAt: addedAt, sequence: b.knn.sequence.Add(1)}
+}
+
+// Build builds the index containing all added values. The builder is reset afterward and can be used to
+// build another index with the same configuration. Values added to the returned index with AddValue are
+// inserted as usual. The values of the builder are not written to a write-ahead log configured by WithWAL.
+func (b *Builder[T]) Build() *KNN[T] {
+	knn := b.knn
+	knn.lookup = buildTree(knn.indexRoot, b.values)
+
+	// The options were validated by NewBuilder, so creating the next index can't fail.
+	b.knn, _ = NewKNN[T](b.precision, b.opts...)
+	b.values = make(map[string]*Value[T])
+	return knn
+}
+
+// buildTree adds the values to the empty root node and returns the lookup map of the values.
+func buildTree[T any](root *Node[T], valuesByID map[string]*Value[T]) map[string]*Node[T] {
+	values := make([]*Value[T], 0, len(valuesByID))
+	for _, value := range valuesByID {
+		values = append(values, value)
+	}
+	slices.SortFunc(values, func(lhs, rhs *Value[T]) int {
+		return cmp.Compare(lhs.cell, rhs.cell)
+	})
+	lookup := make(map[string]*Node[T], len(values))
+	buildSubtree(root, values, lookup)
+	return lookup
+}
+
+// buildSubtree adds the values, sorted by their cell, to the empty node. A node keeps its values if
+// they would not be split by adding them one by one, otherwise every run of values with the same child
+// cell is built into the child.
+func buildSubtree[T any](node *Node[T], values []*Value[T], lookup map[string]*Node[T]) {
+	if len(values) <= maxValuesPerCell || node.Level() >= node.maxIndexDepth {
+		node.valuesMutex.Lock()
+		for _, value := range values {
+			node.appendValue(value)
+			lookup[value.key] = node
+		}
+		node.valuesMutex.Unlock()
+		return
+	}
+	for start := 0; start < len(values); {
+		childCellID := values[start].cell.Parent(node.Level() + 1)
+		end := start + 1
+		for end < len(values) && values[end].cell.Parent(node.Level()+1) == childCellID {
+			end++
+		}
+		buildSubtree(node.GetOrCreateChild(childCellID), values[start:end], lookup)
+		start = end
+	}
+}
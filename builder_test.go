@@ -0,0 +1,74 @@
+package go_sknn
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Builder(t *testing.T) {
+	items := randomItems(10_000)
+	// The last value of a duplicate id wins.
+	items = append(items, Item[int]{ID: "0", Value: -1, Lat: 51.44, Long: 13.55})
+
+	builder, err := NewBuilder[int](14, WithValueSlabs[int]())
+	assert.NoError(t, err)
+	serial, err := NewKNN[int](14, WithValueSlabs[int]())
+	assert.NoError(t, err)
+	for i, item := range items {
+		builder.Add(item.ID, item.Value, item.Lat, item.Long)
+		if i > 0 {
+			serial.AddValue(item.ID, item.Value, item.Lat, item.Long)
+		}
+	}
+	index := builder.Build()
+
+	// The built tree has the same structure as the tree built by adding the values one by one.
+	assert.Equal(t, serial.NodeCount(), index.NodeCount())
+	expectedCounts, actualCounts := serial.indexRoot.ValuesCount(), index.indexRoot.ValuesCount()
+	slices.Sort(expectedCounts)
+	slices.Sort(actualCounts)
+	assert.Equal(t, expectedCounts, actualCounts)
+	assert.Len(t, index.lookup, 10_000)
+	for id, node := range index.lookup {
+		assert.NotNil(t, node.FindValue(id))
+	}
+
+	expected := serial.Query(context.Background(), 51.44, 13.55, WithK[int](100))
+	actual := index.Query(context.Background(), 51.44, 13.55, WithK[int](100))
+	assert.Len(t, actual, 100)
+	for i := range expected {
+		assert.Equal(t, expected[i].Key(), actual[i].Key())
+		assert.Equal(t, expected[i].Value(), actual[i].Value())
+	}
+	assert.Equal(t, -1, actual[0].Value())
+
+	// The built index can be modified like any other index.
+	index.AddValue("new", 1, 0, 0)
+	assert.True(t, index.RemoveValue("new"))
+
+	// The builder is reset by Build.
+	builder.Add("1", 1, 0, 0)
+	other := builder.Build()
+	assert.Equal(t, 1, other.Count())
+	assert.Equal(t, 10_000, index.Count())
+	assert.Zero(t, builder.Build().Count())
+
+	assert.Panics(t, func() { builder.Add("1", 1, 91, 0) })
+	_, err = NewBuilder[int](31)
+	assert.Error(t, err)
+}
+
+func Benchmark_Builder(b *testing.B) {
+	items := randomItems(500_000)
+	b.ResetTimer()
+	for range b.N {
+		builder, _ := NewBuilder[int](14)
+		for _, item := range items {
+			builder.Add(item.ID, item.Value, item.Lat, item.Long)
+		}
+		builder.Build()
+	}
+}
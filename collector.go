@@ -0,0 +1,106 @@
+package go_sknn
+
+import (
+	"context"
+)
+
+// Collector gathers the values found by SearchWith, which offers the values ordered by distance.
+type Collector[T any] interface {
+	// Offer offers the next value and its distance in kilometers. The collector returns whether it accepted
+	// the value and whether the search should stop. The accept result lets collectors wrapping other
+	// collectors know if a value was kept.
+	Offer(v *Value[T], distKM float64) (accept bool, stop bool)
+}
+
+// SearchWith performs an exact nearest neighbor search and offers the found values ordered by distance
+// to the collector, until the collector stops the search or the context is canceled.
+func (a *KNN[T]) SearchWith(ctx context.Context, lat float64, long float64, c Collector[T]) {
+	s := a.newSearcher(lat, long)
+	for {
+		value, distance, ok := s.next(ctx)
+		if !ok {
+			return
+		}
+		if _, stop := c.Offer(value, chordAngleToKM(distance)); stop {
+			return
+		}
+	}
+}
+
+// TopKCollector collects the k nearest values.
+type TopKCollector[T any] struct {
+	k      int
+	values []*Value[T]
+}
+
+// NewTopKCollector creates a collector accepting the first k offered values.
+func NewTopKCollector[T any](k int) *TopKCollector[T] {
+	return &TopKCollector[T]{k: k}
+}
+
+// Offer accepts the value if less than k values were collected and stops once k values are collected.
+func (c *TopKCollector[T]) Offer(v *Value[T], _ float64) (accept bool, stop bool) {
+	if len(c.values) >= c.k {
+		return false, true
+	}
+	c.values = append(c.values, v)
+	return true, len(c.values) >= c.k
+}
+
+// Values returns the collected values in the order they were offered.
+func (c *TopKCollector[T]) Values() []*Value[T] {
+	return c.values
+}
+
+// RadiusCollector collects the values within a radius.
+type RadiusCollector[T any] struct {
+	radiusKM float64
+	values   []*Value[T]
+}
+
+// NewRadiusCollector creates a collector accepting the values within the radius in kilometers.
+func NewRadiusCollector[T any](radiusKM float64) *RadiusCollector[T] {
+	return &RadiusCollector[T]{radiusKM: radiusKM}
+}
+
+// Offer accepts the value if it is within the radius. Since the values are offered ordered by distance,
+// the search is stopped at the first value outside the radius.
+func (c *RadiusCollector[T]) Offer(v *Value[T], distKM float64) (accept bool, stop bool) {
+	if distKM > c.radiusKM {
+		return false, true
+	}
+	c.values = append(c.values, v)
+	return true, false
+}
+
+// Values returns the collected values in the order they were offered.
+func (c *RadiusCollector[T]) Values() []*Value[T] {
+	return c.values
+}
+
+// DedupCollector offers only the first value of every key to the collector it wraps,
+// e.g. to return the nearest value of every distinct payload.
+type DedupCollector[T any, K comparable] struct {
+	key  func(*Value[T]) K
+	next Collector[T]
+	seen map[K]struct{}
+}
+
+// NewDedupCollector creates a collector offering the first value of every key, extracted by key, to next.
+func NewDedupCollector[T any, K comparable](key func(*Value[T]) K, next Collector[T]) *DedupCollector[T, K] {
+	return &DedupCollector[T, K]{key: key, next: next, seen: make(map[K]struct{})}
+}
+
+// Offer rejects the value if a value with the same key was accepted before, otherwise it offers it to the
+// wrapped collector. A key only counts as seen if the wrapped collector accepted its value.
+func (c *DedupCollector[T, K]) Offer(v *Value[T], distKM float64) (accept bool, stop bool) {
+	key := c.key(v)
+	if _, ok := c.seen[key]; ok {
+		return false, false
+	}
+	accept, stop = c.next.Offer(v, distKM)
+	if accept {
+		c.seen[key] = struct{}{}
+	}
+	return accept, stop
+}
@@ -0,0 +1,47 @@
+package go_sknn
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_KNN_SearchWith(t *testing.T) {
+	index, err := BuildConcurrent(14, randomItems(10_000), 2)
+	assert.NoError(t, err)
+	searchLat, searchLong := 48.137, 11.575
+
+	topK := NewTopKCollector[int](10)
+	index.SearchWith(context.Background(), searchLat, searchLong, topK)
+	assert.Equal(t, index.Query(context.Background(), searchLat, searchLong, WithK[int](10)), topK.Values())
+
+	radius := NewRadiusCollector[int](1_000)
+	index.SearchWith(context.Background(), searchLat, searchLong, radius)
+	expected := index.Query(context.Background(), searchLat, searchLong, WithRadiusKM[int](1_000))
+	assert.NotEmpty(t, expected)
+	assert.Equal(t, expected, radius.Values())
+
+	// The nearest value of every remainder.
+	remainder := func(value *Value[int]) int {
+		return value.Value() % 3
+	}
+	nearest := NewTopKCollector[int](3)
+	index.SearchWith(context.Background(), searchLat, searchLong, NewDedupCollector[int](remainder, nearest))
+	var expectedDedup []*Value[int]
+	seen := make(map[int]bool)
+	for _, value := range index.Query(context.Background(), searchLat, searchLong) {
+		if !seen[remainder(value)] {
+			seen[remainder(value)] = true
+			expectedDedup = append(expectedDedup, value)
+		}
+		if len(expectedDedup) == 3 {
+			break
+		}
+	}
+	assert.Equal(t, expectedDedup, nearest.Values())
+
+	empty := NewTopKCollector[int](0)
+	index.SearchWith(context.Background(), searchLat, searchLong, empty)
+	assert.Empty(t, empty.Values())
+}
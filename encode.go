@@ -0,0 +1,138 @@
+package go_sknn
+
+import (
+	"cmp"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/golang/geo/s2"
+)
+
+// encodedIndex is the encoded form of an index written by Encode and MarshalJSON.
+type encodedIndex[T any] struct {
+	Precision int `json:"precision"`
+	// MaxTreeDepth is the depth the tree is split to. It is 0 in indexes encoded before it was added.
+	MaxTreeDepth int `json:"maxTreeDepth"`
+	// Values are ordered by insertion, so the insertion order is kept when the index is rebuilt.
+	Values []encodedValue[T] `json:"values"`
+}
+
+// encodedValue is the encoded form of a value. The time the value was added is not part of the JSON form.
+type encodedValue[T any] struct {
+	ID      string    `json:"id"`
+	Value   T         `json:"value"`
+	Lat     float64   `json:"lat"`
+	Long    float64   `json:"long"`
+	AddedAt time.Time `json:"-"`
+}
+
+// encodeIndex returns the precision, the max tree depth and all values of the index ordered by insertion.
+func (a *KNN[T]) encodeIndex() encodedIndex[T] {
+	a.lookupMutex.Lock()
+	defer a.lookupMutex.Unlock()
+	a.loadAll()
+	values := a.indexRoot.CollectValues(nil)
+	slices.SortFunc(values, func(lhs, rhs *Value[T]) int {
+		return cmp.Compare(lhs.sequence, rhs.sequence)
+	})
+	encoded := encodedIndex[T]{Precision: a.precision, MaxTreeDepth: a.maxTreeDepth, Values: make([]encodedValue[T], len(values))}
+	for i, value := range values {
+		lat, long := value.LatLng()
+		encoded.Values[i] = encodedValue[T]{ID: value.key, Value: value.value, Lat: lat, Long: long, AddedAt: value.addedAt}
+	}
+	return encoded
+}
+
+// Encode writes the precision, the max tree depth and all values of the index with their id, coordinates and
+// the time they were added to w, encoded with encoding/gob. The tree is not written, DecodeKNN rebuilds it.
+// If T is or contains an interface type, the concrete types must be registered with gob.Register.
+// Other configuration of the index, like the other options, is not written.
+func (a *KNN[T]) Encode(w io.Writer) error {
+	if err := gob.NewEncoder(w).Encode(a.encodeIndex()); err != nil {
+		return fmt.Errorf("encode index: %w", err)
+	}
+	return nil
+}
+
+// DecodeKNN reads an index written by Encode from r and rebuilds it with a Builder, using the encoded
+// precision and max tree depth and the given options, which can override the max tree depth.
+// The values keep their insertion order and the time they were added.
+// It returns an error if the index can't be decoded or the options are invalid.
+func DecodeKNN[T any](r io.Reader, opts ...Option[T]) (*KNN[T], error) {
+	var encoded encodedIndex[T]
+	if err := gob.NewDecoder(r).Decode(&encoded); err != nil {
+		return nil, fmt.Errorf("decode index: %w", err)
+	}
+	if encoded.MaxTreeDepth != 0 {
+		opts = append([]Option[T]{WithMaxTreeDepth[T](encoded.MaxTreeDepth)}, opts...)
+	}
+	builder, err := NewBuilder[T](encoded.Precision, opts...)
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range encoded.Values {
+		if err := validateCoordinates(value.Lat, value.Long); err != nil {
+			return nil, fmt.Errorf("value %s: %w", value.ID, err)
+		}
+		builder.add(value.ID, value.Value, value.Lat, value.Long, value.AddedAt)
+	}
+	return builder.Build(), nil
+}
+
+// MarshalJSON encodes the index as JSON object with the precision, the max tree depth and the values, ordered
+// by insertion, as array of objects with the fields id, value, lat and long. The coordinates are the center of
+// the cell of the value. Other configuration of the index, like the other options, is not encoded.
+func (a *KNN[T]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.encodeIndex())
+}
+
+// UnmarshalJSON replaces all values of the index with the values of an index encoded by MarshalJSON and
+// rebuilds the tree, like a Builder does. The index takes the encoded precision and max tree depth, or the
+// precision if the max tree depth isn't encoded, and keeps the rest of its configuration. A zero KNN is
+// configured like an index created by NewKNN without options. The values are added in their encoded order,
+// they are not written to a write-ahead log configured by WithWAL.
+// UnmarshalJSON must not be called concurrently with other methods of the index.
+// It returns an error and leaves the index unchanged if the JSON, the precision, the max tree depth or
+// a coordinate is invalid.
+func (a *KNN[T]) UnmarshalJSON(b []byte) error {
+	var encoded encodedIndex[T]
+	if err := json.Unmarshal(b, &encoded); err != nil {
+		return fmt.Errorf("decode index: %w", err)
+	}
+	if encoded.Precision < MinPrecision || encoded.Precision > MaxPrecision {
+		return fmt.Errorf("invalid precision %d: precision must be between %d and %d", encoded.Precision, MinPrecision, MaxPrecision)
+	}
+	maxTreeDepth := cmp.Or(encoded.MaxTreeDepth, encoded.Precision)
+	if maxTreeDepth < MinPrecision || maxTreeDepth > MaxPrecision {
+		return fmt.Errorf("invalid max tree depth %d: depth must be between %d and %d", maxTreeDepth, MinPrecision, MaxPrecision)
+	}
+	for _, value := range encoded.Values {
+		if err := validateCoordinates(value.Lat, value.Long); err != nil {
+			return fmt.Errorf("value %s: %w", value.ID, err)
+		}
+	}
+
+	a.lookupMutex.Lock()
+	defer a.lookupMutex.Unlock()
+	if a.spill != nil && a.spill.level > maxTreeDepth {
+		return fmt.Errorf("invalid node store level %d: level must be between %d and %d", a.spill.level, MinPrecision, maxTreeDepth)
+	}
+	a.precision, a.maxTreeDepth = encoded.Precision, maxTreeDepth
+	values := make(map[string]*Value[T], len(encoded.Values))
+	for _, value := range encoded.Values {
+		cellID := s2.CellIDFromLatLng(s2.LatLngFromDegrees(value.Lat, value.Long))
+		values[value.ID] = &Value[T]{key: value.ID, value: a.internPayload(value.Value), cell: cellID, addedAt: time.Now(), sequence: a.sequence.Add(1)}
+	}
+	a.indexRoot = a.newRoot()
+	a.lookup = buildTree(a.indexRoot, values)
+	if a.spill != nil {
+		a.spill.mutex.Lock()
+		clear(a.spill.lastUsed)
+		a.spill.mutex.Unlock()
+	}
+	return nil
+}
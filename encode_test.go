@@ -0,0 +1,145 @@
+package go_sknn
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_KNN_Encode(t *testing.T) {
+	type payload struct {
+		Name  string
+		Count int
+	}
+	index, err := NewKNN[payload](14, WithTieBreakByRecency[payload]())
+	assert.NoError(t, err)
+	for _, item := range randomItems(10_000) {
+		index.AddValue(item.ID, payload{Name: "name-" + item.ID, Count: item.Value}, item.Lat, item.Long)
+	}
+	// Colocated values are ordered by their insertion.
+	index.AddValue("first", payload{Name: "first"}, 51.0504, 13.7373)
+	index.AddValue("second", payload{Name: "second"}, 51.0504, 13.7373)
+
+	var buf bytes.Buffer
+	assert.NoError(t, index.Encode(&buf))
+	decoded, err := DecodeKNN[payload](&buf, WithTieBreakByRecency[payload]())
+	assert.NoError(t, err)
+	assert.Equal(t, 14, decoded.precision)
+	assert.Equal(t, index.Len(), decoded.Len())
+	assert.Equal(t, index.Stats(), decoded.Stats())
+
+	r := rand.New(rand.NewSource(2))
+	for range 50 {
+		lat, long := RandLat(r), RandLong(r)
+		expected := index.KNearest(context.Background(), lat, long, 20)
+		actual := decoded.KNearest(context.Background(), lat, long, 20)
+		assert.Len(t, actual, len(expected))
+		for i := range expected {
+			assert.Equal(t, expected[i].Key(), actual[i].Key())
+			assert.Equal(t, expected[i].Value(), actual[i].Value())
+			assert.Equal(t, expected[i].CellID(), actual[i].CellID())
+			assert.True(t, expected[i].AddedAt().Equal(actual[i].AddedAt()))
+		}
+	}
+	colocated := decoded.KNearest(context.Background(), 51.0504, 13.7373, 2)
+	assert.Equal(t, "second", colocated[0].Key())
+	assert.Equal(t, "first", colocated[1].Key())
+
+	_, err = DecodeKNN[payload](bytes.NewReader([]byte("invalid")))
+	assert.ErrorContains(t, err, "decode index")
+}
+
+func Test_KNN_MarshalJSON(t *testing.T) {
+	type payload struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+	index, err := NewKNN[payload](14)
+	assert.NoError(t, err)
+	for _, item := range randomItems(5_000) {
+		index.AddValue(item.ID, payload{Name: "name-" + item.ID, Count: item.Value}, item.Lat, item.Long)
+	}
+	data, err := json.Marshal(index)
+	assert.NoError(t, err)
+
+	var decoded KNN[payload]
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, 14, decoded.precision)
+	assert.Equal(t, index.Len(), decoded.Len())
+	assert.Equal(t, index.Stats(), decoded.Stats())
+
+	// An existing index is replaced and keeps working as usual.
+	replaced, err := NewKNN[payload](20)
+	assert.NoError(t, err)
+	replaced.AddValue("old", payload{Name: "old"}, 10, 10)
+	assert.NoError(t, replaced.UnmarshalJSON(data))
+	assert.False(t, replaced.HasValue("old"))
+	assert.Equal(t, 14, replaced.precision)
+	// The max tree depth is taken from the marshalled index, so the tree is split like the marshalled one.
+	assert.Equal(t, 14, replaced.maxTreeDepth)
+	assert.Equal(t, index.Stats(), replaced.Stats())
+	limited, err := NewKNN[payload](20, WithMaxTreeDepth[payload](10))
+	assert.NoError(t, err)
+	assert.NoError(t, limited.UnmarshalJSON(data))
+	assert.Equal(t, 14, limited.maxTreeDepth)
+	spilled, err := NewKNN[payload](20, WithNodeStore[payload](newMemoryNodeStore(), 16, 4))
+	assert.NoError(t, err)
+	assert.ErrorContains(t, spilled.UnmarshalJSON(data), "invalid node store level 16")
+	replaced.AddValue("new", payload{Name: "new"}, 10, 10)
+	assert.Equal(t, "new", replaced.KNearest(context.Background(), 10, 10, 1)[0].Key())
+	replaced.RemoveValue("new")
+
+	r := rand.New(rand.NewSource(2))
+	for range 50 {
+		lat, long := RandLat(r), RandLong(r)
+		expected := index.KNearest(context.Background(), lat, long, 20)
+		for _, knn := range []*KNN[payload]{&decoded, replaced} {
+			actual := knn.KNearest(context.Background(), lat, long, 20)
+			assert.Len(t, actual, len(expected))
+			for i := range expected {
+				assert.Equal(t, expected[i].Key(), actual[i].Key())
+				assert.Equal(t, expected[i].Value(), actual[i].Value())
+				assert.Equal(t, expected[i].CellID(), actual[i].CellID())
+			}
+		}
+	}
+
+	assert.ErrorContains(t, replaced.UnmarshalJSON([]byte(`{"precision":31,"values":[]}`)), "invalid precision")
+	assert.ErrorContains(t, replaced.UnmarshalJSON([]byte(`{"precision":14,"maxTreeDepth":31,"values":[]}`)), "invalid max tree depth")
+	assert.ErrorContains(t, replaced.UnmarshalJSON([]byte(`{"precision":14,"values":[{"id":"a","lat":91,"long":0}]}`)), "value a")
+	assert.Equal(t, index.Len(), replaced.Len())
+}
+
+func Test_KNN_Encode_MaxTreeDepth(t *testing.T) {
+	// The tree of the index is capped at level 10 and never reaches the precision.
+	index, err := NewKNN[int](20, WithMaxTreeDepth[int](10))
+	assert.NoError(t, err)
+	for _, item := range randomItems(5_000) {
+		index.AddValue(item.ID, item.Value, item.Lat, item.Long)
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, index.Encode(&buf))
+	decoded, err := DecodeKNN[int](&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, decoded.maxTreeDepth)
+	assert.Equal(t, index.Stats(), decoded.Stats())
+
+	data, err := json.Marshal(index)
+	assert.NoError(t, err)
+	var unmarshalled KNN[int]
+	assert.NoError(t, json.Unmarshal(data, &unmarshalled))
+	assert.Equal(t, 20, unmarshalled.precision)
+	assert.Equal(t, 10, unmarshalled.maxTreeDepth)
+	assert.Equal(t, index.Stats(), unmarshalled.Stats())
+
+	// Without an encoded max tree depth the tree is split to the precision.
+	legacy, err := NewKNN[int](20, WithMaxTreeDepth[int](10))
+	assert.NoError(t, err)
+	assert.NoError(t, legacy.UnmarshalJSON([]byte(`{"precision":14,"values":[]}`)))
+	assert.Equal(t, 14, legacy.maxTreeDepth)
+}
@@ -74,12 +74,7 @@ func SearchApproximate(index *go_sknn.KNN[int], lat, long float64) {
 }
 
 func Search(index *go_sknn.KNN[int], lat, long float64) {
-	result := make([]*go_sknn.Value[int], 0, 10)
-	searchFunc := func(value *go_sknn.Value[int]) bool {
-		result = append(result, value)
-		return len(result) >= 10
-	}
-	index.Search(context.Background(), lat, long, searchFunc)
+	result := index.KNearest(context.Background(), lat, long, 10)
 	for i, value := range result {
 		fmt.Printf("%d User: %s, Distance: %.2f km\n", i, value.Key(), value.DistanceKM(lat, long))
 	}
@@ -25,12 +25,7 @@ func main() {
 		index.AddValue(fmt.Sprintf("user-%d", i), i, RandLat(r), RandLong(r))
 	}
 
-	result := make([]*go_sknn.Value[int], 0, 400)
-	searchFunc := func(value *go_sknn.Value[int]) bool {
-		result = append(result, value)
-		return len(result) >= 400
-	}
-	index.Search(context.Background(), 51.0504, 13.7373, searchFunc)
+	result := index.KNearest(context.Background(), 51.0504, 13.7373, 400)
 	ctx := sm.NewContext()
 	ctx.SetSize(1920, 1080)
 
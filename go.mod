@@ -6,7 +6,6 @@ require (
 	github.com/flopp/go-staticmaps v0.0.0-20240606055734-0bdd9c1c1478
 	github.com/fogleman/gg v1.3.0
 	github.com/golang/geo v0.0.0-20230421003525-6adc56603217
-	github.com/oleiade/lane/v2 v2.0.0
 	github.com/stretchr/testify v1.9.0
 )
 
@@ -17,7 +16,6 @@ require (
 	github.com/mazznoer/csscolorparser v0.1.3 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/tkrajina/gpxgo v1.4.0 // indirect
-	golang.org/x/exp v0.0.0-20220827204233-334a2380cb91 // indirect
 	golang.org/x/image v0.23.0 // indirect
 	golang.org/x/net v0.33.0 // indirect
 	golang.org/x/text v0.21.0 // indirect
@@ -1,12 +1,21 @@
 package go_sknn
 
 import (
+	"cmp"
 	"context"
+	"encoding/json"
 	"fmt"
+	"maps"
+	"math"
+	"math/rand"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/golang/geo/r3"
+	"github.com/golang/geo/s1"
 	"github.com/golang/geo/s2"
-	"github.com/oleiade/lane/v2"
 )
 
 const (
@@ -14,55 +23,348 @@ const (
 	MaxPrecision = 30
 )
 
+const (
+	// maxOverflowRatio is the ratio of leaves exceeding maxValuesPerCell above which NeedsRebalance reports a rebalance.
+	maxOverflowRatio = 0.1
+	// maxEmptyRatio is the ratio of empty nodes above which NeedsRebalance reports a rebalance.
+	maxEmptyRatio = 0.25
+)
+
+// KNN is a nearest neighbor index of values with a location. Searches and modifications like AddValue,
+// RemoveValue and UpsertValue are safe for concurrent use: searches read every node under its read lock,
+// and a node that splits publishes its children and gives up its values in one step, so a search finds every
+// value either in the node or in its children.
 type KNN[T any] struct {
-	indexRoot   *Node[T]
-	precision   int
-	lookup      map[string]*Node[T]
-	lookupMutex sync.RWMutex
+	indexRoot    *Node[T]
+	precision    int
+	maxTreeDepth int
+	cacheCells   bool
+	useSlabs     bool
+	tieBreak     func(lhs *Value[T], rhs *Value[T]) int
+	sequence     atomic.Uint64
+	lookup       map[string]*Node[T]
+	lookupMutex  sync.RWMutex
+	latency      *latencyRecorder
+	wal          *walWriter
+	// intern returns the canonical copy of a payload if payload interning is enabled.
+	intern func(T) T
+	// spill tracks the subtrees which can be evicted to a node store, it is nil if no node store is used.
+	spill *spillState
+}
+
+// Option configures optional behavior of the KNN index.
+type Option[T any] func(*KNN[T])
+
+// WithLatencyTracking enables recording the latency of Search and SearchApproximate calls.
+// The recorded latencies are available via LatencyStats.
+func WithLatencyTracking[T any]() Option[T] {
+	return func(a *KNN[T]) {
+		a.latency = newLatencyRecorder()
+	}
 }
 
-func NewKNN[T any](precision int) (*KNN[T], error) {
+// WithMaxTreeDepth caps the depth of the search tree independently of the precision.
+// Values are always stored with their full resolution cell, so distances stay exact,
+// but nodes are not split below the given level. This bounds the memory used by the tree
+// for dense data. Leaves at the depth cap can hold more values than usual, which increases
+// the error margin of SearchApproximate and the number of values compared by Search.
+func WithMaxTreeDepth[T any](depth int) Option[T] {
+	return func(a *KNN[T]) {
+		a.maxTreeDepth = depth
+	}
+}
+
+// WithCellCache enables caching the S2 cell geometry of every node when the node is created.
+// Searches don't have to rebuild the cells to calculate distances, which makes them faster
+// at the cost of additional memory per node.
+func WithCellCache[T any]() Option[T] {
+	return func(a *KNN[T]) {
+		a.cacheCells = true
+	}
+}
+
+// WithValueSlabs stores the values of every leaf in a single contiguous slice instead of
+// allocating them individually. Searches iterate the values of a leaf with better cache locality,
+// which speeds up searches over dense leaves.
+//
+// A slab is never modified after its values were handed out: removing or updating a value copies the slab
+// of its leaf, so a *Value returned by a search stays valid and unchanged like in the default mode.
+// The values of a leaf are moved to a new slab by these copies, so pointers to the values of the same
+// leaf returned by different searches may differ.
+func WithValueSlabs[T any]() Option[T] {
+	return func(a *KNN[T]) {
+		a.useSlabs = true
+	}
+}
+
+// WithTieBreakByRecency orders values with the same distance by their insertion order,
+// so the most recently added value is returned first.
+func WithTieBreakByRecency[T any]() Option[T] {
+	return func(a *KNN[T]) {
+		a.tieBreak = func(lhs *Value[T], rhs *Value[T]) int {
+			return cmp.Compare(rhs.sequence, lhs.sequence)
+		}
+	}
+}
+
+// WithPayloadInterning keeps a single canonical copy of every distinct payload, which all values with an
+// equal payload share. It reduces the memory of payloads with few distinct values which reference memory,
+// like strings or structs with strings, because the referenced memory is only kept once.
+// Canonical payloads are kept even after all values with the payload are removed.
+func WithPayloadInterning[T comparable]() Option[T] {
+	return func(a *KNN[T]) {
+		var mutex sync.Mutex
+		canonical := make(map[T]T)
+		a.intern = func(value T) T {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if existing, ok := canonical[value]; ok {
+				return existing
+			}
+			canonical[value] = value
+			return value
+		}
+	}
+}
+
+// WithSecondarySort orders values with the same distance ascending by the key extracted from their payload.
+// Values with equal keys are ordered by a tie break given by a previous option like WithTieBreakByRecency.
+func WithSecondarySort[T any](key func(T) int) Option[T] {
+	return func(a *KNN[T]) {
+		previous := a.tieBreak
+		a.tieBreak = func(lhs *Value[T], rhs *Value[T]) int {
+			if c := cmp.Compare(key(lhs.value), key(rhs.value)); c != 0 || previous == nil {
+				return c
+			}
+			return previous(lhs, rhs)
+		}
+	}
+}
+
+func NewKNN[T any](precision int, opts ...Option[T]) (*KNN[T], error) {
 	if precision < MinPrecision || precision > MaxPrecision {
 		return nil, fmt.Errorf("invalid precision %d: precision must be between %d and %d", precision, MinPrecision, MaxPrecision)
 	}
-	return &KNN[T]{
-		indexRoot: &Node[T]{maxIndexDepth: precision},
-		lookup:    make(map[string]*Node[T]),
-		precision: precision,
-	}, nil
+	knn := &KNN[T]{
+		lookup:       make(map[string]*Node[T]),
+		precision:    precision,
+		maxTreeDepth: precision,
+	}
+	for _, opt := range opts {
+		opt(knn)
+	}
+	if knn.maxTreeDepth < MinPrecision || knn.maxTreeDepth > MaxPrecision {
+		return nil, fmt.Errorf("invalid max tree depth %d: depth must be between %d and %d", knn.maxTreeDepth, MinPrecision, MaxPrecision)
+	}
+	if knn.spill != nil && (knn.spill.level < MinPrecision || knn.spill.level > knn.maxTreeDepth) {
+		return nil, fmt.Errorf("invalid node store level %d: level must be between %d and %d", knn.spill.level, MinPrecision, knn.maxTreeDepth)
+	}
+	knn.indexRoot = knn.newRoot()
+	return knn, nil
 }
 
-// AddValue adds a new value to the search tree.
-// The function will panic if the latitude or longitude are out of bounds.
-func (a *KNN[T]) AddValue(id string, value T, lat float64, long float64) {
+// newRoot creates an empty root node for the search tree.
+func (a *KNN[T]) newRoot() *Node[T] {
+	return &Node[T]{maxIndexDepth: a.maxTreeDepth, cacheCells: a.cacheCells, useSlab: a.useSlabs}
+}
+
+// emptyCopy creates a new empty index with the same configuration.
+func (a *KNN[T]) emptyCopy() *KNN[T] {
+	knn := &KNN[T]{
+		lookup:       make(map[string]*Node[T]),
+		precision:    a.precision,
+		maxTreeDepth: a.maxTreeDepth,
+		cacheCells:   a.cacheCells,
+		useSlabs:     a.useSlabs,
+		tieBreak:     a.tieBreak,
+		intern:       a.intern,
+	}
+	knn.sequence.Store(a.sequence.Load())
+	knn.indexRoot = knn.newRoot()
+	return knn
+}
+
+// insertValue adds the value to the tree below root and keeps the lookup map up to date,
+// including the values moved by node splits.
+func insertValue[T any](root *Node[T], lookup map[string]*Node[T], value *Value[T]) {
+	node := root.AddValue(value, func(moved *Value[T], node *Node[T]) {
+		lookup[moved.key] = node
+	})
+	lookup[value.key] = node
+}
+
+// validateCoordinates returns an error if the latitude or longitude are out of bounds.
+func validateCoordinates(lat float64, long float64) error {
 	if long < -180 || long > 180 || lat < -90 || lat > 90 {
-		panic(fmt.Sprintf("invalid latitude %f (Min:-90, Max 90) or longitude %f (Min: -180, Max 180)", lat, long))
+		return fmt.Errorf("invalid latitude %f (Min:-90, Max 90) or longitude %f (Min: -180, Max 180)", lat, long)
+	}
+	return nil
+}
+
+// validateLevel panics if the cell level is not between MinPrecision and MaxPrecision.
+func validateLevel(level int) {
+	if level < MinPrecision || level > MaxPrecision {
+		panic(fmt.Sprintf("invalid level %d: level must be between %d and %d", level, MinPrecision, MaxPrecision))
+	}
+}
+
+// AddValue adds a new value to the search tree. If a value with the id already exists, it is replaced,
+// so an id is never stored twice. The function will panic if the latitude or longitude are out of bounds.
+func (a *KNN[T]) AddValue(id string, value T, lat float64, long float64) {
+	if err := a.TryAddValue(id, value, lat, long); err != nil {
+		panic(err.Error())
+	}
+}
+
+// TryAddValue adds a new value to the search tree like AddValue, but returns an error instead of panicking
+// if the latitude or longitude are out of bounds. The index is not changed in that case.
+func (a *KNN[T]) TryAddValue(id string, value T, lat float64, long float64) error {
+	if err := validateCoordinates(lat, long); err != nil {
+		return err
 	}
+	a.addValue(id, value, lat, long)
+	return nil
+}
+
+// addValue adds a new value to the search tree and appends it to the write-ahead log.
+// The coordinates must be valid.
+func (a *KNN[T]) addValue(id string, value T, lat float64, long float64) {
+	payload := a.internPayload(value)
 	// Calculate the Cell which the value belongs to.
 	cellID := s2.CellIDFromLatLng(s2.LatLngFromDegrees(lat, long))
-	node := a.indexRoot.AddValue(id, value, cellID)
-	// Add the node to the lookup map.
+	// Add the value to the tree and the lookup map. The lock is held during the insert,
+	// because a node split moves values and changes their lookup entries. The record is appended
+	// under the lock as well, so the log has the same order as the changes of the index.
 	a.lookupMutex.Lock()
-	a.lookup[id] = node
+	a.storeValue(&Value[T]{key: id, value: payload, cell: cellID, addedAt: time.Now(), sequence: a.sequence.Add(1)})
+	a.logWAL(walAdd, id, value, lat, long)
 	a.lookupMutex.Unlock()
 }
 
-// RemoveValue removes a value from the search tree.
+// storeValue adds the value to the tree and the lookup map. The caller must hold the lookup lock.
+func (a *KNN[T]) storeValue(value *Value[T]) {
+	// Remove an existing value with the id, otherwise it would stay in its node without a lookup entry.
+	if node, ok := a.nodeOf(value.key); ok {
+		a.detachValue(node, value.key)
+	}
+	a.loadCell(value.cell)
+	insertValue(a.indexRoot, a.lookup, value)
+}
+
+// AddValues adds many values like AddValue, but takes the lookup lock only once for all of them, which is faster
+// than adding them one by one. The cells of the values are calculated before the lock is taken. If the index is
+// empty, the tree is built at once like a Builder does, without splitting any nodes. If an id appears multiple
+// times, the last item with that id is kept. The function will panic before adding any value if the latitude
+// or longitude of an item are out of bounds.
+func (a *KNN[T]) AddValues(items []Item[T]) {
+	if errs := a.TryAddValues(items); errs != nil {
+		panic(errs[0].Error())
+	}
+}
+
+// TryAddValues adds many values like AddValues, but returns an error for every item with a latitude or longitude
+// out of bounds instead of panicking. The index is not changed if any item is invalid.
+func (a *KNN[T]) TryAddValues(items []Item[T]) []error {
+	var errs []error
+	for _, item := range items {
+		if err := validateCoordinates(item.Lat, item.Long); err != nil {
+			errs = append(errs, fmt.Errorf("item %s: %w", item.ID, err))
+		}
+	}
+	if errs != nil {
+		return errs
+	}
+	values := make([]*Value[T], len(items))
+	now := time.Now()
+	for i, item := range items {
+		cellID := s2.CellIDFromLatLng(s2.LatLngFromDegrees(item.Lat, item.Long))
+		values[i] = &Value[T]{key: item.ID, value: a.internPayload(item.Value), cell: cellID, addedAt: now}
+	}
+
+	a.lookupMutex.Lock()
+	if len(a.lookup) == 0 && a.indexRoot.isEmptyLeaf() {
+		// The nodes of an empty index are created with their final values, instead of splitting them repeatedly.
+		valuesByID := make(map[string]*Value[T], len(values))
+		for _, value := range values {
+			value.sequence = a.sequence.Add(1)
+			valuesByID[value.key] = value
+		}
+		a.lookup = buildTree(a.indexRoot, valuesByID)
+	} else {
+		for _, value := range values {
+			value.sequence = a.sequence.Add(1)
+			a.storeValue(value)
+		}
+	}
+	for _, item := range items {
+		a.logWAL(walAdd, item.ID, item.Value, item.Lat, item.Long)
+	}
+	a.lookupMutex.Unlock()
+	return nil
+}
+
+// RemoveValue removes a value from the search tree. The node of the value and its ancestors are removed
+// as well if they are empty afterward, so adding and removing values doesn't grow the tree.
 // The function will return false if the value was not found and true if the value
 // was removed successfully.
 func (a *KNN[T]) RemoveValue(id string) bool {
+	return a.removeValue(id)
+}
+
+// removeValue removes a value from the search tree and appends the removal to the write-ahead log.
+func (a *KNN[T]) removeValue(id string) bool {
 	a.lookupMutex.Lock()
 	defer a.lookupMutex.Unlock()
 
-	node, ok := a.lookup[id]
+	node, ok := a.nodeOf(id)
 	if !ok {
 		return false
 	}
-	// Remove the value from the search index.
+	a.detachValue(node, id)
+	var zero T
+	a.logWAL(walRemove, id, zero, 0, 0)
+	return true
+}
+
+// detachValue removes the value of id from its node and the lookup map, and removes the node and its
+// ancestors from the tree if they are empty afterward. The caller must hold the lookup lock.
+func (a *KNN[T]) detachValue(node *Node[T], id string) {
 	node.RemoveValue(id)
-	// Remove the value from the lookup map.
 	delete(a.lookup, id)
-	return true
+	node.Prune()
+}
+
+// PopValue removes the value stored for id and returns its payload. The payload is read and the value removed
+// under a single lock, so the returned payload is exactly the removed one.
+// The function returns the zero value and false if the id does not exist.
+func (a *KNN[T]) PopValue(id string) (T, bool) {
+	a.lookupMutex.Lock()
+	node, ok := a.nodeOf(id)
+	var value T
+	if ok {
+		if stored := node.FindValue(id); stored != nil {
+			value = stored.value
+		}
+		a.detachValue(node, id)
+		var zero T
+		a.logWAL(walRemove, id, zero, 0, 0)
+	}
+	a.lookupMutex.Unlock()
+	return value, ok
+}
+
+// Count returns the number of values stored in the search tree. It walks the whole tree.
+func (a *KNN[T]) Count() int {
+	_, values := a.indexRoot.SubtreeCount()
+	return values
+}
+
+// Len returns the number of values in the index from the lookup map, without walking the tree.
+// In contrast to Count it includes the values evicted to a node store.
+func (a *KNN[T]) Len() int {
+	a.lookupMutex.RLock()
+	defer a.lookupMutex.RUnlock()
+	return len(a.lookup)
 }
 
 // HasValue checks if a value exists in the search tree.
@@ -76,27 +378,79 @@ func (a *KNN[T]) HasValue(id string) bool {
 // UpsertValue updates a value in the search tree or inserts the value if it does not exist.
 // The function will panic if the latitude or longitude are out of bounds.
 func (a *KNN[T]) UpsertValue(id string, value T, lat float64, long float64) {
-	// Check if we have to update or insert the value.
+	if err := a.TryUpsertValue(id, value, lat, long); err != nil {
+		panic(err.Error())
+	}
+}
+
+// TryUpsertValue updates or inserts a value like UpsertValue, but returns an error instead of panicking
+// if the latitude or longitude are out of bounds. The index is not changed in that case.
+func (a *KNN[T]) TryUpsertValue(id string, value T, lat float64, long float64) error {
+	if err := validateCoordinates(lat, long); err != nil {
+		return err
+	}
+	a.upsertValue(id, value, lat, long)
+	return nil
+}
+
+// upsertValue updates or inserts a value and appends it to the write-ahead log.
+// The coordinates must be valid.
+func (a *KNN[T]) upsertValue(id string, value T, lat float64, long float64) {
+	payload := a.internPayload(value)
 	cellID := s2.CellIDFromLatLng(s2.LatLngFromDegrees(lat, long))
-	a.lookupMutex.RLock()
-	node, ok := a.lookup[id]
+	// The lock is held from the lookup to the update, so a concurrent split can't move the value in between.
+	a.lookupMutex.Lock()
+	defer a.lookupMutex.Unlock()
+	// The record is appended under the lock, so the log has the same order as the changes of the index.
+	defer a.logWAL(walUpsert, id, value, lat, long)
+	if node, ok := a.nodeOf(id); ok {
+		// If the location is the same, we just have to update the value in the node.
+		// This avoids removing and adding the valid from the node, which is more expensive.
+		// The cell of the stored value has to be compared, because the cell of the node is coarser.
+		if stored := node.FindValue(id); stored != nil && stored.cell == cellID && node.UpdateValue(id, payload) {
+			return
+		}
+	}
+	// If the value does not exist or the cell has changed, the value is added, which removes the existing value.
+	a.storeValue(&Value[T]{key: id, value: payload, cell: cellID, addedAt: time.Now(), sequence: a.sequence.Add(1)})
+}
+
+// SwapValue replaces the payload and location of the value stored for id, or inserts it if it does not exist,
+// and returns the previous value. The swap is done under a single lock, so concurrent writes can't
+// change the value between reading the previous value and writing the new one.
+// The function returns false if the id did not exist and panics if the latitude or longitude are out of bounds.
+func (a *KNN[T]) SwapValue(id string, value T, lat float64, long float64) (old *Value[T], existed bool) {
+	if err := validateCoordinates(lat, long); err != nil {
+		panic(err.Error())
+	}
+	cellID := s2.CellIDFromLatLng(s2.LatLngFromDegrees(lat, long))
+	a.lookupMutex.Lock()
+	if node, ok := a.nodeOf(id); ok {
+		if stored := node.FindValue(id); stored != nil {
+			old, existed = stored, true
+		}
+		a.detachValue(node, id)
+	}
+	a.loadCell(cellID)
+	insertValue(a.indexRoot, a.lookup, &Value[T]{key: id, value: a.internPayload(value), cell: cellID, addedAt: time.Now(), sequence: a.sequence.Add(1)})
+	a.logWAL(walUpsert, id, value, lat, long)
 	a.lookupMutex.Unlock()
+	return old, existed
+}
 
-	// If the value does not exist, we add it.
+// UpdatePayload replaces the value stored for id without changing its location.
+// In contrast to UpsertValue the search tree is not modified, only the node holding the value is locked.
+// The function returns false if the id does not exist.
+func (a *KNN[T]) UpdatePayload(id string, value T) bool {
+	// Hold the lock during the update, so the value can't be removed or evicted concurrently.
+	unlock := a.lockLookup()
+	defer unlock()
+
+	node, ok := a.nodeOf(id)
 	if !ok {
-		a.AddValue(id, value, lat, long)
-		return
-	}
-	// If the value exists, we update it.
-	// If the cell is the same, we just have to update the value in the node.
-	// This avoids removing and adding the valid from the node, which is more expensive.
-	if node.cellID == cellID {
-		node.UpdateValue(id, value)
-		return
+		return false
 	}
-	// If the cell has changed, the only way to update the value is to remove it and add it again.
-	a.RemoveValue(id)
-	a.AddValue(id, value, lat, long)
+	return node.UpdateValue(id, a.internPayload(value))
 }
 
 // SearchApproximate performs an approximate nearest neighbor search in the K-Nearest Neighbors (KNN) index.
@@ -106,58 +460,1288 @@ func (a *KNN[T]) UpsertValue(id string, value T, lat float64, long float64) {
 // The found values are not guaranteed to be ordered perfectly by distance.
 // It has an error margin which is defines by the precision of the KNN.
 // A higher precision will result in a more accurate search but will be slower and consume more memory.
+// The values of a leaf are ranked by their own distance, so at very low precisions, where a few huge leaves
+// hold almost all values, the values are still returned ordered by distance instead of in the order of the leaf.
+// Use Query with WithExact(false) or SearchApproximateAtPrecision to skip ranking the values of a leaf.
 func (a *KNN[T]) SearchApproximate(ctx context.Context, lat float64, long float64, callback func(*Value[T]) bool) {
-	point := s2.PointFromLatLng(s2.LatLngFromDegrees(lat, long))
-	priorityQueue := lane.NewMinPriorityQueue[interface{}, float64]()
-	priorityQueue.Push(a.indexRoot, 0)
+	a.SearchApproximateWithOrdering(ctx, lat, long, OrderBestFirst, callback)
+}
+
+// NearestExcludingRegion returns the k nearest values to the given coordinates which are outside of the loop.
+// Subtrees whose cell is completely inside the loop are skipped without visiting their values.
+func (a *KNN[T]) NearestExcludingRegion(ctx context.Context, lat float64, long float64, exclude *s2.Loop, k int) []*Value[T] {
+	s := a.newSearcher(lat, long)
+	s.exclude = exclude
+	return resultValues(s.nearest(ctx, k))
+}
+
+// Ordering defines the order in which an approximate search returns the values.
+type Ordering int
+
+const (
+	// OrderBestFirst returns the values of the closest cells first.
+	OrderBestFirst Ordering = iota
+	// OrderRings groups the leaf cells into rings around the search location, which are as wide as a cell
+	// at the max tree depth. All values of a ring are returned before the values of the next ring,
+	// but within a ring the values are not ordered by distance. The values of a leaf cell are always
+	// returned together, which keeps the results visually stable.
+	OrderRings
+)
+
+// SearchApproximateWithOrdering performs an approximate nearest neighbor search like SearchApproximate
+// and returns the values in the given order.
+func (a *KNN[T]) SearchApproximateWithOrdering(ctx context.Context, lat float64, long float64, ordering Ordering, callback func(*Value[T]) bool) {
+	if a.latency != nil {
+		defer a.recordLatency(time.Now())
+	}
+	s := a.newSearcher(lat, long)
+	if ordering == OrderRings {
+		s.ringWidth = a.ringWidthKM()
+	}
 	for {
-		if ctx.Err() != nil {
+		value, _, ok := s.next(ctx)
+		if !ok || callback(value) {
 			return
 		}
-		poppedNode, _, ok := priorityQueue.Pop()
+	}
+}
+
+// SearchApproximateBucketed performs an approximate nearest neighbor search like SearchApproximate,
+// but passes a coarse distance bucket instead of the value's exact distance to the callback.
+// The exact distance of a value is never computed, a value is ranked by the distance of its leaf cell.
+//
+// The bucket is the number of thresholds in thresholdsKM, which must be sorted ascending, that are lower than
+// the distance of the leaf cell. For the thresholds [1, 10] the buckets are 0 (close, below 1 km),
+// 1 (medium, below 10 km) and 2 (far). The leaf cell distance is a lower bound of the exact distance
+// and differs at most by the diameter of the leaf cell, so a value close to a threshold can be put
+// in the lower bucket. The buckets of the values are non-decreasing.
+func (a *KNN[T]) SearchApproximateBucketed(ctx context.Context, lat float64, long float64, thresholdsKM []float64, callback func(value *Value[T], bucket int) bool) {
+	if a.latency != nil {
+		defer a.recordLatency(time.Now())
+	}
+	s := a.newSearcher(lat, long)
+	s.coarse = true
+	for {
+		value, distance, ok := s.next(ctx)
 		if !ok {
 			return
 		}
-		switch node := poppedNode.(type) {
-		case *Node[T]:
-			if node.IsLeaveNode() {
-				node.AddValuesToQueue(point, priorityQueue.Push)
-			} else {
-				node.AddChildrenToQueueInterface(point, priorityQueue.Push)
-			}
-		case *Value[T]:
-			if callback(node) {
-				return
-			}
+		bucket, _ := slices.BinarySearch(thresholdsKM, chordAngleToKM(distance))
+		if callback(value, bucket) {
+			return
 		}
 	}
 }
 
+// ringWidthKM returns the width of the rings used by OrderRings, which is the average edge length of a leaf cell.
+func (a *KNN[T]) ringWidthKM() float64 {
+	return s2.AvgEdgeMetric.Value(a.maxTreeDepth) * earthRadiusKm
+}
+
 // Search performs an exact nearest neighbor search in the K-Nearest Neighbors (KNN) index.
 // It has the same specification as SearchApproximate, but the values are guaranteed to be ordered by distance.
 func (a *KNN[T]) Search(ctx context.Context, lat float64, long float64, callback func(*Value[T]) bool) {
-	point := s2.PointFromLatLng(s2.LatLngFromDegrees(lat, long))
-	priorityQueue := lane.NewMinPriorityQueue[interface{}, float64]()
-	priorityQueue.Push(a.indexRoot, 0)
+	a.query(ctx, lat, long, query[T]{exact: true, radiusKM: math.Inf(1)}, callback)
+}
+
+// SearchWithinRadiusKM performs an exact nearest neighbor search like Search, limited to the values within the
+// radius in kilometers. The radius is converted to a chord angle once, and the search ends as soon as the nearest
+// remaining node or value is beyond it, instead of walking the whole tree.
+func (a *KNN[T]) SearchWithinRadiusKM(ctx context.Context, lat float64, long float64, radiusKM float64, callback func(*Value[T]) bool) {
+	a.query(ctx, lat, long, query[T]{exact: true, radiusKM: radiusKM}, callback)
+}
+
+// SearchInto performs an exact nearest neighbor search and appends the found values to buf.
+// The search stops as soon as buf is filled up to its capacity, so the capacity of buf
+// defines the number of returned values. The filled slice is returned.
+//
+// It allows callers to reuse the same buffer across searches (buf = buf[:0])
+// to avoid allocating a new result slice for every query.
+func (a *KNN[T]) SearchInto(ctx context.Context, lat float64, long float64, buf []*Value[T]) []*Value[T] {
+	buf = buf[:0]
+	if cap(buf) == 0 {
+		return buf
+	}
+	a.Search(ctx, lat, long, func(value *Value[T]) bool {
+		buf = append(buf, value)
+		return len(buf) >= cap(buf)
+	})
+	return buf
+}
+
+// SearchWithMetrics performs an exact nearest neighbor search like Search
+// and returns metrics about the work done by the search.
+func (a *KNN[T]) SearchWithMetrics(ctx context.Context, lat float64, long float64, callback func(*Value[T]) bool) SearchMetrics {
+	s := a.newSearcher(lat, long)
 	for {
-		if ctx.Err() != nil {
-			return
+		value, _, ok := s.next(ctx)
+		if !ok || callback(value) {
+			return s.searchMetrics()
+		}
+	}
+}
+
+// EstimateSearchCost estimates the number of nodes and values a search for the k nearest values
+// around the given coordinates would visit, without running the search.
+//
+// The estimate is based on the tree structure around the search location: it looks for the smallest
+// node containing the location which holds at least k values, and assumes the search visits that subtree.
+// Searches close to cell boundaries will also visit neighboring cells, so the estimate is only a rough guide.
+func (a *KNN[T]) EstimateSearchCost(lat float64, long float64, k int) int {
+	cellID := s2.CellIDFromLatLng(s2.LatLngFromDegrees(lat, long))
+	// Find the path from the root to the deepest node containing the location.
+	path := []*Node[T]{a.indexRoot}
+	for {
+		child := path[len(path)-1].ChildContaining(cellID)
+		if child == nil {
+			break
+		}
+		path = append(path, child)
+	}
+	// Walk up the path until a node holds enough values to satisfy the search.
+	for i := len(path) - 1; i >= 0; i-- {
+		nodes, values := path[i].SubtreeCount()
+		if values >= k || i == 0 {
+			// The ancestors of the node are visited too.
+			return i + nodes + min(values, k)
+		}
+	}
+	return 0
+}
+
+func (a *KNN[T]) recordLatency(start time.Time) {
+	a.latency.record(time.Since(start))
+}
+
+// LatencyStats returns the p50, p95 and p99 latencies of the recorded searches.
+// The latencies are only recorded if the index was created with WithLatencyTracking,
+// otherwise the returned stats are empty.
+func (a *KNN[T]) LatencyStats() LatencyStat {
+	if a.latency == nil {
+		return LatencyStat{}
+	}
+	return a.latency.stats()
+}
+
+// Transform moves all values of the index to the coordinates returned by fn and rebuilds the search tree.
+// The function is called once per value with its current coordinates.
+// The function will panic if fn returns a latitude or longitude which is out of bounds.
+// The new tree is built off to the side and swapped into the root under its locks like in Clear, so a concurrent
+// search either sees the whole index as it was before or the transformed index.
+func (a *KNN[T]) Transform(fn func(lat float64, long float64) (float64, float64)) {
+	a.lookupMutex.Lock()
+	defer a.lookupMutex.Unlock()
+
+	a.loadAll()
+	values := a.indexRoot.CollectValues(nil)
+	root := a.newRoot()
+	lookup := make(map[string]*Node[T], len(values))
+	for _, value := range values {
+		latLng := value.cell.LatLng()
+		lat, long := fn(latLng.Lat.Degrees(), latLng.Lng.Degrees())
+		if err := validateCoordinates(lat, long); err != nil {
+			panic(err.Error())
 		}
-		poppedNode, _, ok := priorityQueue.Pop()
+		cellID := s2.CellIDFromLatLng(s2.LatLngFromDegrees(lat, long))
+		insertValue(root, lookup, &Value[T]{key: value.key, value: value.value, cell: cellID, addedAt: value.addedAt, sequence: value.sequence})
+	}
+	// The new children aren't visible yet, so they can be moved to the existing root without their locks.
+	indexRoot := a.indexRoot
+	for _, child := range root.children {
+		child.parent = indexRoot
+	}
+	for key, node := range lookup {
+		if node == root {
+			lookup[key] = indexRoot
+		}
+	}
+	indexRoot.valuesMutex.Lock()
+	indexRoot.childMutex.Lock()
+	indexRoot.children = root.children
+	indexRoot.values = root.values
+	indexRoot.slab = root.slab
+	indexRoot.childMutex.Unlock()
+	indexRoot.valuesMutex.Unlock()
+	a.lookup = lookup
+}
+
+// Clear removes all values from the index, keeping its configuration and the memory of the lookup map.
+// The root node is emptied under its locks, so a concurrent search either sees the whole index as it was
+// before, because it already reached the children of the root, or the empty index. The old nodes and values
+// are not modified, so values returned by searches before Clear stay valid.
+func (a *KNN[T]) Clear() {
+	a.lookupMutex.Lock()
+	defer a.lookupMutex.Unlock()
+
+	root := a.indexRoot
+	root.valuesMutex.Lock()
+	root.childMutex.Lock()
+	root.children = nil
+	root.values = nil
+	root.slab = nil
+	root.childMutex.Unlock()
+	root.valuesMutex.Unlock()
+	clear(a.lookup)
+	if a.spill != nil {
+		a.spill.mutex.Lock()
+		clear(a.spill.lastUsed)
+		a.spill.mutex.Unlock()
+	}
+}
+
+// SearchWithPeek returns all values within radiusKM of the given coordinates ordered by distance,
+// and additionally the nearest value outside the radius as peek.
+// The peek is nil if there is no value outside the radius or if the context is canceled.
+func (a *KNN[T]) SearchWithPeek(ctx context.Context, lat float64, long float64, radiusKM float64) (inside []*Value[T], peek *Value[T]) {
+	s := a.newSearcher(lat, long)
+	for {
+		value, distance, ok := s.next(ctx)
 		if !ok {
+			return inside, nil
+		}
+		if chordAngleToKM(distance) > radiusKM {
+			return inside, value
+		}
+		inside = append(inside, value)
+	}
+}
+
+// FillRatioByLevel returns for each level from 0 to the precision of the index
+// the ratio of cells containing at least one value to the total number of cells at that level.
+// It helps choosing a precision: low fill ratios indicate clustered data with a lot of empty space.
+func (a *KNN[T]) FillRatioByLevel() map[int]float64 {
+	a.lookupMutex.Lock()
+	a.loadAll()
+	values := a.indexRoot.CollectValues(nil)
+	a.lookupMutex.Unlock()
+
+	result := make(map[int]float64, a.precision+1)
+	for level := 0; level <= a.precision; level++ {
+		occupied := make(map[s2.CellID]struct{})
+		for _, value := range values {
+			occupied[value.cell.Parent(level)] = struct{}{}
+		}
+		// There are 6 faces and every cell has 4 children.
+		totalCells := 6 * math.Pow(4, float64(level))
+		result[level] = float64(len(occupied)) / totalCells
+	}
+	return result
+}
+
+// NearestInWindow returns the k nearest values to the given coordinates which were added at or after since.
+// Values added before since are skipped.
+func (a *KNN[T]) NearestInWindow(ctx context.Context, lat float64, long float64, since time.Time, k int) []*Value[T] {
+	result := make([]*Value[T], 0, k)
+	if k <= 0 {
+		return result
+	}
+	a.Search(ctx, lat, long, func(value *Value[T]) bool {
+		if value.addedAt.Before(since) {
+			return false
+		}
+		result = append(result, value)
+		return len(result) >= k
+	})
+	return result
+}
+
+// SearchTimeWindow returns the k nearest values to the given coordinates which were added within [from, to].
+// The values outside of the time window are skipped during the search and don't count towards k.
+func (a *KNN[T]) SearchTimeWindow(ctx context.Context, lat float64, long float64, from time.Time, to time.Time, k int) []*Value[T] {
+	return a.Query(ctx, lat, long, WithK[T](k), WithFilter(func(value *Value[T]) bool {
+		return !value.addedAt.Before(from) && !value.addedAt.After(to)
+	}))
+}
+
+// SearchWithDistance performs an exact nearest neighbor search like Search, but the callback additionally
+// receives the distance of the value in kilometers. It is the distance the value was ordered by in the search,
+// so it doesn't have to be computed again. It is measured to the leaf cell of the value instead of its center,
+// so it differs from Value.DistanceKM by less than a centimeter.
+func (a *KNN[T]) SearchWithDistance(ctx context.Context, lat float64, long float64, callback func(value *Value[T], distanceKM float64) bool) {
+	if a.latency != nil {
+		defer a.recordLatency(time.Now())
+	}
+	s := a.newSearcher(lat, long)
+	for {
+		value, distance, ok := s.next(ctx)
+		if !ok || callback(value, chordAngleToKM(distance)) {
+			return
+		}
+	}
+}
+
+// SearchWithLeafCell performs an exact nearest neighbor search like Search,
+// but the callback additionally receives the cell of the leaf node the value is stored in.
+// In contrast to the cell of the value, the leaf cell reflects how the index partitions the values,
+// which is useful to group results by index partition. As long as the index holds too few values to be split,
+// the values are stored in the root, which covers the whole sphere; the face cell of the value is passed then.
+func (a *KNN[T]) SearchWithLeafCell(ctx context.Context, lat float64, long float64, callback func(value *Value[T], leafCell s2.CellID) bool) {
+	s := a.newSearcher(lat, long)
+	s.trackLeaf = true
+	for {
+		value, _, ok := s.next(ctx)
+		if !ok || callback(value, s.leaf.leafCell(value)) {
+			return
+		}
+	}
+}
+
+// Shard splits the index into n indexes with approximately the same number of values.
+// The values are ordered along the S2 Hilbert curve and split into contiguous ranges,
+// so every shard covers a compact area. The shards are independent copies of the index
+// with the same precision. The function returns nil if n is smaller than 1.
+func (a *KNN[T]) Shard(n int) []*KNN[T] {
+	if n < 1 {
+		return nil
+	}
+	a.lookupMutex.Lock()
+	a.loadAll()
+	values := a.indexRoot.CollectValues(nil)
+	a.lookupMutex.Unlock()
+
+	// Cell ids are ordered along the Hilbert curve.
+	slices.SortFunc(values, func(lhs, rhs *Value[T]) int {
+		return cmp.Compare(lhs.cell, rhs.cell)
+	})
+
+	shards := make([]*KNN[T], n)
+	for i := range shards {
+		shard := a.emptyCopy()
+		start, end := i*len(values)/n, (i+1)*len(values)/n
+		for _, value := range values[start:end] {
+			copied := *value
+			insertValue(shard.indexRoot, shard.lookup, &copied)
+		}
+		shards[i] = shard
+	}
+	return shards
+}
+
+// SearchFederated returns the k nearest values to the given coordinates across multiple indexes,
+// for example the shards created by Shard. The indexes are searched concurrently
+// and the results are merged by distance.
+func SearchFederated[T any](ctx context.Context, indexes []*KNN[T], lat float64, long float64, k int) []*Value[T] {
+	if k <= 0 {
+		return []*Value[T]{}
+	}
+	results := make([][]searchResult[T], len(indexes))
+	var wg sync.WaitGroup
+	for i, index := range indexes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = index.newSearcher(lat, long).nearest(ctx, k)
+		}()
+	}
+	wg.Wait()
+
+	merged := slices.Concat(results...)
+	// Equal distances of different indexes are ordered by the tie break of the first index.
+	var tieBreak func(lhs *Value[T], rhs *Value[T]) int
+	if len(indexes) > 0 {
+		tieBreak = indexes[0].tieBreak
+	}
+	slices.SortStableFunc(merged, func(lhs, rhs searchResult[T]) int {
+		if c := cmp.Compare(lhs.distance, rhs.distance); c != 0 || tieBreak == nil {
+			return c
+		}
+		return tieBreak(lhs.value, rhs.value)
+	})
+	return resultValues(merged[:min(k, len(merged))])
+}
+
+// SearchApproximateAtPrecision performs an approximate nearest neighbor search like SearchApproximate,
+// but treats the nodes at the given precision as leaves. All values below such a node are passed to the
+// callback in arbitrary order once the node is reached, without searching the deeper levels of the tree.
+// This allows a single high precision index to serve fast coarse queries as well as accurate ones.
+//
+// The function returns an error if the effective precision is negative or greater than the precision of the index.
+func (a *KNN[T]) SearchApproximateAtPrecision(ctx context.Context, lat float64, long float64, effectivePrecision int, callback func(*Value[T]) bool) error {
+	if effectivePrecision < MinPrecision || effectivePrecision > a.precision {
+		return fmt.Errorf("invalid effective precision %d: precision must be between %d and %d", effectivePrecision, MinPrecision, a.precision)
+	}
+	s := a.newSearcher(lat, long)
+	s.leafLevel = effectivePrecision
+	for {
+		value, _, ok := s.next(ctx)
+		if !ok || callback(value) {
+			return nil
+		}
+	}
+}
+
+// Item is a value with its id and coordinates, used to add many values at once.
+type Item[T any] struct {
+	ID    string
+	Value T
+	Lat   float64
+	Long  float64
+}
+
+// BuildConcurrent creates a new index containing the given items. The items are partitioned
+// by their S2 face and the subtree of every face is built by its own goroutine, using at most
+// the given number of workers. Since the faces don't share any nodes, the goroutines don't contend.
+//
+// The function returns an error if the precision is invalid or if any item has invalid coordinates.
+// If an id appears multiple times, the last item with that id is indexed. If the index has a write-ahead log
+// configured by WithWAL, an add record of every indexed item is appended to it in the order of the items.
+func BuildConcurrent[T any](precision int, items []Item[T], workers int, opts ...Option[T]) (*KNN[T], error) {
+	knn, err := NewKNN[T](precision, opts...)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if err := validateCoordinates(item.Lat, item.Long); err != nil {
+			return nil, fmt.Errorf("item %s: %w", item.ID, err)
+		}
+	}
+	knn.buildFaces(items, workers)
+	return knn, nil
+}
+
+// BuildParallel fills the empty index with the given items like BuildConcurrent, keeping the configuration
+// of the index. It is intended for the one-shot construction of an index right after NewKNN and must not be
+// called concurrently with other methods of the index. The indexed items are written to the write-ahead log
+// like by BuildConcurrent.
+// The function will panic if the index is not empty or if the latitude or longitude of an item are out of bounds.
+func (a *KNN[T]) BuildParallel(items []Item[T], workers int) {
+	if len(a.lookup) != 0 || !a.indexRoot.isEmptyLeaf() {
+		panic("BuildParallel requires an empty index")
+	}
+	for _, item := range items {
+		if err := validateCoordinates(item.Lat, item.Long); err != nil {
+			panic(fmt.Sprintf("item %s: %s", item.ID, err))
+		}
+	}
+	a.buildFaces(items, workers)
+}
+
+// buildFaces builds the subtree of every face of the empty index in parallel and appends the indexed items
+// to the write-ahead log. The coordinates must be valid.
+func (a *KNN[T]) buildFaces(items []Item[T], workers int) {
+	// Keep only the last item of every id.
+	last := make(map[string]int, len(items))
+	for i, item := range items {
+		last[item.ID] = i
+	}
+	// Partition the items by face.
+	var faces [6][]*Value[T]
+	now := time.Now()
+	for i, item := range items {
+		if last[item.ID] != i {
+			continue
+		}
+		cellID := s2.CellIDFromLatLng(s2.LatLngFromDegrees(item.Lat, item.Long))
+		value := &Value[T]{key: item.ID, value: a.internPayload(item.Value), cell: cellID, addedAt: now, sequence: a.sequence.Add(1)}
+		faces[cellID.Face()] = append(faces[cellID.Face()], value)
+	}
+
+	// Build the subtree of every face in parallel.
+	faceLookups := make([]map[string]*Node[T], len(faces))
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, max(workers, 1))
+	for face, values := range faces {
+		if len(values) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			node := a.indexRoot.GetOrCreateChild(s2.CellIDFromFace(face))
+			lookup := make(map[string]*Node[T], len(values))
+			for _, value := range values {
+				insertValue(node, lookup, value)
+			}
+			faceLookups[face] = lookup
+		}()
+	}
+	wg.Wait()
+
+	// Merge the lookup maps of the faces.
+	a.lookup = make(map[string]*Node[T], len(last))
+	for _, lookup := range faceLookups {
+		maps.Copy(a.lookup, lookup)
+	}
+	for i, item := range items {
+		if last[item.ID] == i {
+			a.logWAL(walAdd, item.ID, item.Value, item.Lat, item.Long)
+		}
+	}
+}
+
+// KNearest returns up to k values nearest to the given coordinates, ordered by distance. It performs an exact
+// search like Search and stops as soon as k values were found. If the index holds fewer than k values or the
+// context is canceled, fewer values are returned.
+func (a *KNN[T]) KNearest(ctx context.Context, lat float64, long float64, k int) []*Value[T] {
+	if a.latency != nil {
+		defer a.recordLatency(time.Now())
+	}
+	s := a.newSearcher(lat, long)
+	return resultValues(s.nearest(ctx, k))
+}
+
+// KNearestWithin returns up to k values nearest to the given coordinates which are within maxKM, ordered by distance.
+// The search stops as soon as k values were found or the next value is farther away than maxKM.
+func (a *KNN[T]) KNearestWithin(ctx context.Context, lat float64, long float64, k int, maxKM float64) []*Value[T] {
+	s := a.newSearcher(lat, long)
+	s.limit = kmToChordAngle(maxKM)
+	return resultValues(s.nearest(ctx, k))
+}
+
+// ValuesOutside returns all values whose location is not contained by the region.
+// Subtrees whose cell is completely inside the region are skipped.
+func (a *KNN[T]) ValuesOutside(region *s2.Loop) []*Value[T] {
+	var result []*Value[T]
+	a.indexRoot.WalkNodes(func(node *Node[T]) bool {
+		if node.parent != nil && region.ContainsCell(s2.CellFromCellID(node.cellID)) {
+			return false
+		}
+		node.FilerValues(func(value *Value[T]) bool {
+			if !region.ContainsPoint(value.cell.Point()) {
+				result = append(result, value)
+			}
+			return false
+		})
+		return true
+	})
+	return result
+}
+
+// PruneableNodes returns the number of nodes which would be removed by Prune,
+// which are the nodes without values and without descendants holding values.
+// The tree is not modified.
+func (a *KNN[T]) PruneableNodes() int {
+	a.lookupMutex.RLock()
+	defer a.lookupMutex.RUnlock()
+	count, empty := a.indexRoot.CountEmpty()
+	// The root is never removed.
+	if empty {
+		count--
+	}
+	return count
+}
+
+// Prune removes all nodes without values and without descendants holding values from the search tree.
+// Removing a value already removes the nodes it leaves empty, so the tree normally contains no such nodes.
+func (a *KNN[T]) Prune() {
+	a.lookupMutex.Lock()
+	defer a.lookupMutex.Unlock()
+	a.indexRoot.PruneEmpty()
+}
+
+// Interleave searches two indexes at the same time and merges their results by distance.
+// For the k nearest values of both indexes, onA or onB is called with the value and its distance in kilometers,
+// in order of increasing distance. Both searches advance step by step, so no result set is collected and sorted.
+func Interleave[A any, B any](ctx context.Context, lat float64, long float64, a *KNN[A], b *KNN[B], k int, onA func(*Value[A], float64), onB func(*Value[B], float64)) {
+	searchA, searchB := a.newSearcher(lat, long), b.newSearcher(lat, long)
+	valueA, distanceA, okA := searchA.next(ctx)
+	valueB, distanceB, okB := searchB.next(ctx)
+	for range k {
+		switch {
+		case okA && (!okB || distanceA <= distanceB):
+			onA(valueA, chordAngleToKM(distanceA))
+			valueA, distanceA, okA = searchA.next(ctx)
+		case okB:
+			onB(valueB, chordAngleToKM(distanceB))
+			valueB, distanceB, okB = searchB.next(ctx)
+		default:
 			return
 		}
-		switch node := poppedNode.(type) {
-		case *Node[T]:
-			if node.IsLeaveNode() {
-				node.AddValuesToQueue(point, priorityQueue.Push)
-			} else {
-				node.AddChildrenToQueueInterface(point, priorityQueue.Push)
+	}
+}
+
+// SearchWithSiblingCount performs an exact nearest neighbor search like Search, but the callback additionally
+// receives the number of siblings of the leaf node the value is stored in. These are the other nodes within
+// the parent cell of the leaf. A leaf without siblings indicates a sparse area where the result is isolated,
+// many siblings indicate a dense area.
+func (a *KNN[T]) SearchWithSiblingCount(ctx context.Context, lat float64, long float64, callback func(value *Value[T], siblings int) bool) {
+	s := a.newSearcher(lat, long)
+	s.trackLeaf = true
+	for {
+		value, _, ok := s.next(ctx)
+		if !ok || callback(value, s.leaf.SiblingCount()) {
+			return
+		}
+	}
+}
+
+// SearchExpanding returns up to k values nearest to the given coordinates, ordered by distance.
+// The search starts with a radius of initialKM and doubles the radius until k values are found
+// or the radius covers the whole globe. The search continues where it stopped with the smaller radius,
+// so the values and nodes within the previous radius are not visited again.
+//
+// In the worst case, if the index has less than k values, the radius is doubled until it covers the globe
+// and all values of the index are visited. A non-positive initialKM is treated as one meter.
+func (a *KNN[T]) SearchExpanding(ctx context.Context, lat float64, long float64, initialKM float64, k int) []*Value[T] {
+	// The farthest point on the globe is half of the circumference away.
+	maxKM := math.Pi * earthRadiusKm
+	radiusKM := max(initialKM, 0.001)
+
+	s := a.newSearcher(lat, long)
+	values := make([]*Value[T], 0, max(k, 0))
+	for len(values) < k && ctx.Err() == nil {
+		s.limit = kmToChordAngle(radiusKM)
+		for _, result := range s.nearest(ctx, k-len(values)) {
+			values = append(values, result.value)
+		}
+		if radiusKM >= maxKM {
+			break
+		}
+		radiusKM *= 2
+	}
+	return values
+}
+
+// CellCount is the number of values stored in a leaf cell of the index.
+type CellCount struct {
+	CellID s2.CellID
+	Count  int
+}
+
+// Fingerprint returns the occupied leaf cells of the index with their number of values, sorted by cell id.
+// Comparing the fingerprints of two snapshots shows where the data changed. As long as the index holds too few
+// values to be split, the values are stored in the root, which covers the whole sphere; they are counted by face cell then.
+func (a *KNN[T]) Fingerprint() []CellCount {
+	var result []CellCount
+	a.indexRoot.WalkNodes(func(node *Node[T]) bool {
+		node.valuesMutex.RLock()
+		defer node.valuesMutex.RUnlock()
+		if node.parent == nil {
+			var faces [6]int
+			for _, value := range node.values {
+				faces[value.cell.Face()]++
+			}
+			for face, count := range faces {
+				if count > 0 {
+					result = append(result, CellCount{CellID: s2.CellIDFromFace(face), Count: count})
+				}
+			}
+		} else if len(node.values) > 0 {
+			result = append(result, CellCount{CellID: node.cellID, Count: len(node.values)})
+		}
+		return true
+	})
+	slices.SortFunc(result, func(lhs, rhs CellCount) int {
+		return cmp.Compare(lhs.CellID, rhs.CellID)
+	})
+	return result
+}
+
+// TileAgg is the aggregate of the values in a tile cell.
+type TileAgg[T any] struct {
+	// Count is the number of values in the tile cell.
+	Count int
+	// Representative is the value reduced from all values in the tile cell.
+	Representative T
+}
+
+// TileAggregates groups the values of the index by their ancestor cell at the given level and returns
+// the number of values and a representative for every occupied tile cell. The representative is computed
+// by reduce from the values of the tile cell. The function panics if the level is not a valid S2 level.
+func (a *KNN[T]) TileAggregates(level int, reduce func([]*Value[T]) T) map[s2.CellID]TileAgg[T] {
+	validateLevel(level)
+	tiles := make(map[s2.CellID][]*Value[T])
+	for _, value := range a.indexRoot.CollectValues(nil) {
+		tile := value.cell.Parent(level)
+		tiles[tile] = append(tiles[tile], value)
+	}
+	result := make(map[s2.CellID]TileAgg[T], len(tiles))
+	for tile, values := range tiles {
+		result[tile] = TileAgg[T]{Count: len(values), Representative: reduce(values)}
+	}
+	return result
+}
+
+// internPayload returns the canonical copy of the payload if payload interning is enabled.
+func (a *KNN[T]) internPayload(value T) T {
+	if a.intern == nil {
+		return value
+	}
+	return a.intern(value)
+}
+
+// GetValue returns the payload stored for id. It returns the zero value and false if the id does not exist.
+func (a *KNN[T]) GetValue(id string) (T, bool) {
+	unlock := a.lockLookup()
+	defer unlock()
+	var value T
+	node, ok := a.nodeOf(id)
+	if !ok {
+		return value, false
+	}
+	stored := node.FindValue(id)
+	if stored == nil {
+		return value, false
+	}
+	return stored.value, true
+}
+
+// GetLocation returns the coordinates of the value stored for id, like Value.LatLng.
+// It returns false if the id does not exist.
+func (a *KNN[T]) GetLocation(id string) (lat, long float64, ok bool) {
+	stored := a.findValue(id)
+	if stored == nil {
+		return 0, 0, false
+	}
+	lat, long = stored.LatLng()
+	return lat, long, true
+}
+
+// findValue returns the value stored for id or nil if the id does not exist.
+func (a *KNN[T]) findValue(id string) *Value[T] {
+	unlock := a.lockLookup()
+	defer unlock()
+	node, ok := a.nodeOf(id)
+	if !ok {
+		return nil
+	}
+	return node.FindValue(id)
+}
+
+// CellCorridor returns the occupied cells at the precision of the index which form a corridor along the
+// great circle between the values fromID and toID. A cell belongs to the corridor if its distance to the
+// great circle segment is at most widthCells times the average edge length of a cell, so a width of 0
+// only contains the cells the segment passes through. The cells are ordered by their position along the segment,
+// starting with the cell of fromID. The function returns nil if one of the ids does not exist.
+func (a *KNN[T]) CellCorridor(fromID, toID string, widthCells int) []s2.CellID {
+	from, to := a.findValue(fromID), a.findValue(toID)
+	if from == nil || to == nil {
+		return nil
+	}
+	start, end := from.cell.Point(), to.cell.Point()
+	width := s1.ChordAngleFromAngle(s1.Angle(float64(widthCells) * s2.AvgEdgeMetric.Value(a.precision)))
+
+	// The position of a cell is the angle between the start and the projection of its center onto the segment.
+	positions := make(map[s2.CellID]s1.Angle)
+	for _, value := range a.indexRoot.CollectValues(nil) {
+		cellID := value.cell.Parent(a.precision)
+		if _, ok := positions[cellID]; ok {
+			continue
+		}
+		cell := s2.CellFromCellID(cellID)
+		if cell.DistanceToEdge(start, end) > width {
+			continue
+		}
+		positions[cellID] = start.Distance(s2.Project(cell.Center(), start, end))
+	}
+	result := make([]s2.CellID, 0, len(positions))
+	for cellID := range positions {
+		result = append(result, cellID)
+	}
+	slices.SortFunc(result, func(lhs, rhs s2.CellID) int {
+		return cmp.Or(cmp.Compare(positions[lhs], positions[rhs]), cmp.Compare(lhs, rhs))
+	})
+	return result
+}
+
+// ValuesAt returns all values within toleranceMeters of the given coordinates.
+// It is a radius search optimized for small tolerances: only the nodes whose cell is within the tolerance
+// are visited, which for an exact coordinate is the path from the root to the leaf of the coordinate.
+func (a *KNN[T]) ValuesAt(lat float64, long float64, toleranceMeters float64) []*Value[T] {
+	point := s2.PointFromLatLng(s2.LatLngFromDegrees(lat, long))
+	limit := s1.ChordAngle(kmToChordAngle(toleranceMeters / 1000))
+	var result []*Value[T]
+	a.indexRoot.WalkNodes(func(node *Node[T]) bool {
+		if node.parent != nil && s1.ChordAngle(node.Distance(point)) > limit {
+			return false
+		}
+		node.FilerValues(func(value *Value[T]) bool {
+			if s2.ChordAngleBetweenPoints(point, value.cell.Point()) <= limit {
+				result = append(result, value)
+			}
+			return false
+		})
+		return true
+	})
+	return result
+}
+
+// NodeCount returns the number of nodes in the search tree, including the root and all internal and leaf nodes.
+// Compared with the number of values it shows the memory overhead of the tree.
+func (a *KNN[T]) NodeCount() int {
+	count := 0
+	a.indexRoot.WalkNodes(func(*Node[T]) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+// IndexStats describes the size of the index.
+type IndexStats struct {
+	// Values is the number of values in the index.
+	Values int
+	// Nodes is the number of nodes in the search tree, see NodeCount.
+	Nodes int
+	// Leaves is the number of nodes holding values. Empty nodes left behind by removed values are not counted.
+	Leaves int
+	// MaxValuesPerLeaf and AvgValuesPerLeaf are the maximum and the average number of values of the leaves.
+	MaxValuesPerLeaf int
+	AvgValuesPerLeaf float64
+}
+
+// String returns a human-readable summary of the statistics.
+func (s IndexStats) String() string {
+	return fmt.Sprintf("%d values in %d leaves (max %d, avg %.1f per leaf), %d nodes",
+		s.Values, s.Leaves, s.MaxValuesPerLeaf, s.AvgValuesPerLeaf, s.Nodes)
+}
+
+// Stats returns the statistics of the index. It walks the whole tree. Many values per leaf indicate
+// a too low precision, many nodes per value a too high one.
+func (a *KNN[T]) Stats() IndexStats {
+	var stats IndexStats
+	a.indexRoot.WalkNodes(func(node *Node[T]) bool {
+		node.valuesMutex.RLock()
+		values := len(node.values)
+		node.valuesMutex.RUnlock()
+		stats.Nodes++
+		if values > 0 {
+			stats.Values += values
+			stats.Leaves++
+			stats.MaxValuesPerLeaf = max(stats.MaxValuesPerLeaf, values)
+		}
+		return true
+	})
+	if stats.Leaves > 0 {
+		stats.AvgValuesPerLeaf = float64(stats.Values) / float64(stats.Leaves)
+	}
+	return stats
+}
+
+// RelativeResult is a value found by NearestRelative with its position relative to the search location and heading.
+type RelativeResult[T any] struct {
+	Value      *Value[T]
+	DistanceKM float64
+	// BearingDeg is the bearing of the value relative to the heading in degrees clockwise in the range [0, 360),
+	// so 0 is ahead, 90 is to the right, 180 is behind and 270 is to the left.
+	BearingDeg float64
+}
+
+// NearestRelative returns the k nearest values ordered by distance, with their distance and their bearing
+// relative to the given heading in degrees clockwise from north. It serves views centered on a moving observer.
+func (a *KNN[T]) NearestRelative(ctx context.Context, lat float64, long float64, headingDeg float64, k int) []RelativeResult[T] {
+	origin := s2.LatLngFromDegrees(lat, long)
+	s := a.newSearcher(lat, long)
+	results := s.nearest(ctx, k)
+	relative := make([]RelativeResult[T], len(results))
+	for i, result := range results {
+		relative[i] = RelativeResult[T]{
+			Value:      result.value,
+			DistanceKM: result.value.DistanceKM(lat, long),
+			BearingDeg: normalizeDeg(bearingDeg(origin, result.value.cell.LatLng()) - headingDeg),
+		}
+	}
+	return relative
+}
+
+// nearestJSON is the JSON representation of a value returned by NearestJSON.
+type nearestJSON struct {
+	ID         string          `json:"id"`
+	Lat        float64         `json:"lat"`
+	Long       float64         `json:"long"`
+	DistanceKM float64         `json:"distanceKm"`
+	Value      json.RawMessage `json:"value"`
+}
+
+// NearestJSON returns the k nearest values ordered by distance as JSON array of objects with the fields
+// id, lat, long, distanceKm and value, where value is the JSON encoded payload. The coordinates are the
+// center of the cell of the value. It returns an error if a payload can't be encoded.
+func (a *KNN[T]) NearestJSON(ctx context.Context, lat float64, long float64, k int) ([]byte, error) {
+	s := a.newSearcher(lat, long)
+	results := s.nearest(ctx, k)
+	values := make([]nearestJSON, len(results))
+	for i, result := range results {
+		payload, err := json.Marshal(result.value.value)
+		if err != nil {
+			return nil, fmt.Errorf("marshal value %s: %w", result.value.key, err)
+		}
+		position := result.value.cell.LatLng()
+		values[i] = nearestJSON{
+			ID:         result.value.key,
+			Lat:        position.Lat.Degrees(),
+			Long:       position.Lng.Degrees(),
+			DistanceKM: chordAngleToKM(result.distance),
+			Value:      payload,
+		}
+	}
+	return json.Marshal(values)
+}
+
+// Rect is a rectangle of coordinates in degrees. It must not cross the antimeridian, so MinLong <= MaxLong.
+type Rect struct {
+	MinLat  float64
+	MinLong float64
+	MaxLat  float64
+	MaxLong float64
+}
+
+// s2Rect returns the rectangle as S2 rectangle.
+func (r Rect) s2Rect() s2.Rect {
+	return s2.RectFromLatLng(s2.LatLngFromDegrees(r.MinLat, r.MinLong)).AddPoint(s2.LatLngFromDegrees(r.MaxLat, r.MaxLong))
+}
+
+// DensityGrid counts the values inside the bounds in a grid of rows x cols cells of equal size in degrees.
+// Row 0 is the northernmost row and column 0 the westernmost column, so the grid can be rendered as an image.
+// Values on the edge between two grid cells are counted in the southern or eastern grid cell.
+// The bounds must not cross the antimeridian. The function returns nil if rows or cols is not positive
+// or if the bounds are empty.
+func (a *KNN[T]) DensityGrid(bounds Rect, rows, cols int) [][]int {
+	if rows <= 0 || cols <= 0 || bounds.MinLat >= bounds.MaxLat || bounds.MinLong >= bounds.MaxLong {
+		return nil
+	}
+	grid := make([][]int, rows)
+	for row := range grid {
+		grid[row] = make([]int, cols)
+	}
+	latStep := (bounds.MaxLat - bounds.MinLat) / float64(rows)
+	longStep := (bounds.MaxLong - bounds.MinLong) / float64(cols)
+	region := bounds.s2Rect()
+	a.indexRoot.WalkNodes(func(node *Node[T]) bool {
+		// Skip the subtrees outside of the bounds.
+		if node.parent != nil && !region.Intersects(s2.CellFromCellID(node.cellID).RectBound()) {
+			return false
+		}
+		node.FilerValues(func(value *Value[T]) bool {
+			latLng := value.cell.LatLng()
+			lat, long := latLng.Lat.Degrees(), latLng.Lng.Degrees()
+			if lat < bounds.MinLat || lat > bounds.MaxLat || long < bounds.MinLong || long > bounds.MaxLong {
+				return false
 			}
-		case *Value[T]:
-			if callback(node) {
-				return
+			row := min(int((bounds.MaxLat-lat)/latStep), rows-1)
+			col := min(int((long-bounds.MinLong)/longStep), cols-1)
+			grid[row][col]++
+			return false
+		})
+		return true
+	})
+	return grid
+}
+
+// CentroidOfNearest returns the centroid of the k nearest values to the given coordinates.
+// The points of the values are summed as vectors on the unit sphere, which in contrast to averaging the
+// coordinates is correct near the poles and the antimeridian. It returns false if there are no results.
+func (a *KNN[T]) CentroidOfNearest(ctx context.Context, lat float64, long float64, k int) (s2.LatLng, bool) {
+	s := a.newSearcher(lat, long)
+	results := s.nearest(ctx, k)
+	if len(results) == 0 {
+		return s2.LatLng{}, false
+	}
+	var sum r3.Vector
+	for _, result := range results {
+		sum = sum.Add(result.value.cell.Point().Vector)
+	}
+	return s2.LatLngFromPoint(s2.Point{Vector: sum.Normalize()}), true
+}
+
+// SearchWatermark performs an exact nearest neighbor search like Search and passes the current watermark
+// in kilometers with every value to emit. All values closer than the watermark have been emitted,
+// so a client can treat the results below the watermark as final. The watermark is the distance of the
+// emitted value and never decreases. The search stops if emit returns true or if the context is canceled.
+func (a *KNN[T]) SearchWatermark(ctx context.Context, lat float64, long float64, emit func(v *Value[T], watermarkKM float64) bool) {
+	s := a.newSearcher(lat, long)
+	for {
+		value, distance, ok := s.next(ctx)
+		if !ok || emit(value, chordAngleToKM(distance)) {
+			return
+		}
+	}
+}
+
+// SkewCoefficient returns the Gini coefficient of the number of values in all cells at the given level,
+// including the empty cells. It is 0 if the values are distributed uniformly over the cells and close to 1
+// if all values are concentrated in a single cell. An empty index has the coefficient 0.
+// The function panics if the level is not a valid S2 level.
+func (a *KNN[T]) SkewCoefficient(level int) float64 {
+	validateLevel(level)
+	counts := make(map[s2.CellID]int)
+	for _, value := range a.indexRoot.CollectValues(nil) {
+		counts[value.cell.Parent(level)]++
+	}
+	if len(counts) == 0 {
+		return 0
+	}
+	occupied := make([]int, 0, len(counts))
+	for _, count := range counts {
+		occupied = append(occupied, count)
+	}
+	slices.Sort(occupied)
+	// The counts sorted ascending start with the empty cells, which don't contribute to the weighted sum.
+	cells := 6 * math.Pow(4, float64(level))
+	empty := cells - float64(len(occupied))
+	weightedSum, total := 0.0, 0.0
+	for i, count := range occupied {
+		weightedSum += (empty + float64(i) + 1) * float64(count)
+		total += float64(count)
+	}
+	return 2*weightedSum/(cells*total) - (cells+1)/cells
+}
+
+// CoverageGaps covers the region with cells at the given level and returns the cells which contain no values,
+// sorted by cell id. Large empty areas show up as many adjacent gaps. The function panics if the level is not
+// a valid S2 level.
+func (a *KNN[T]) CoverageGaps(region s2.Region, level int) []s2.CellID {
+	validateLevel(level)
+	coverer := &s2.RegionCoverer{MinLevel: level, MaxLevel: level, MaxCells: math.MaxInt}
+	var gaps []s2.CellID
+	for _, cellID := range coverer.Covering(region) {
+		if !a.hasValuesIn(cellID) {
+			gaps = append(gaps, cellID)
+		}
+	}
+	return gaps
+}
+
+// hasValuesIn returns true if any value of the index is inside the cell.
+// Only the nodes whose cell intersects the cell are visited.
+func (a *KNN[T]) hasValuesIn(cellID s2.CellID) bool {
+	found := false
+	a.indexRoot.WalkNodes(func(node *Node[T]) bool {
+		if found || (node.parent != nil && !node.cellID.Intersects(cellID)) {
+			return false
+		}
+		found = node.FilerValues(func(value *Value[T]) bool {
+			return cellID.Contains(value.cell)
+		})
+		return !found
+	})
+	return found
+}
+
+// NeedsRebalance compares the occupancy of the leaves with maxValuesPerCell and reports whether rebuilding
+// or pruning the index would help, together with a human-readable reason.
+// Leaves exceed the capacity if they are at the max tree depth and can't be split, which a higher max tree depth
+// fixes. Empty nodes are removed by Prune.
+func (a *KNN[T]) NeedsRebalance() (bool, string) {
+	leaves, overflowing, values := 0, 0, 0
+	a.indexRoot.WalkNodes(func(node *Node[T]) bool {
+		if !node.IsLeaveNode() {
+			return true
+		}
+		node.valuesMutex.RLock()
+		count := len(node.values)
+		node.valuesMutex.RUnlock()
+		if count == 0 {
+			return true
+		}
+		leaves++
+		values += count
+		if count > maxValuesPerCell {
+			overflowing++
+		}
+		return true
+	})
+	nodes, empty := a.NodeCount(), a.PruneableNodes()
+	if leaves > 0 && float64(overflowing)/float64(leaves) > maxOverflowRatio {
+		return true, fmt.Sprintf("%.0f%% of leaves exceed capacity of %d values due to max-depth overflow at depth %d",
+			100*float64(overflowing)/float64(leaves), maxValuesPerCell, a.maxTreeDepth)
+	}
+	if float64(empty)/float64(nodes) > maxEmptyRatio {
+		return true, fmt.Sprintf("%.0f%% of nodes are empty, prune the index to remove them", 100*float64(empty)/float64(nodes))
+	}
+	if leaves == 0 {
+		return false, "the index is empty"
+	}
+	return false, fmt.Sprintf("%d leaves hold %.1f values on average", leaves, float64(values)/float64(leaves))
+}
+
+// Cursor marks the position of RadiusPage in the results of a radius search.
+// The zero value starts at the beginning of the results.
+type Cursor struct {
+	started bool
+	// distance and key are the distance as chord angle and the key of the last returned value.
+	distance float64
+	key      string
+}
+
+// RadiusPage returns the next page of up to pageSize values within radiusKM of the given coordinates, starting
+// after the cursor. The values are ordered by distance and values with equal distance by their key, so paging
+// through the results returns every value once. It returns the cursor of the next page and whether more values
+// remain within the radius. A pageSize less than 1 is treated as 1.
+//
+// Every page searches from the beginning and skips the values before the cursor, so later pages are slower.
+// Values added or removed between the calls can be missed or returned if they are before the cursor.
+func (a *KNN[T]) RadiusPage(ctx context.Context, lat float64, long float64, radiusKM float64, cursor Cursor, pageSize int) ([]*Value[T], Cursor, bool) {
+	pageSize = max(pageSize, 1)
+	s := a.newSearcher(lat, long)
+	s.limit = kmToChordAngle(radiusKM)
+	var page []searchResult[T]
+	more := false
+	for {
+		value, distance, ok := s.next(ctx)
+		if !ok {
+			break
+		}
+		if cursor.started && (distance < cursor.distance || distance == cursor.distance && value.key <= cursor.key) {
+			continue
+		}
+		// All values with the distance of the last value are collected, because they are ordered by their key.
+		if len(page) >= pageSize && distance > page[len(page)-1].distance {
+			more = true
+			break
+		}
+		page = append(page, searchResult[T]{value: value, distance: distance})
+	}
+	slices.SortStableFunc(page, func(lhs, rhs searchResult[T]) int {
+		return cmp.Or(cmp.Compare(lhs.distance, rhs.distance), cmp.Compare(lhs.value.key, rhs.value.key))
+	})
+	if len(page) > pageSize {
+		page = page[:pageSize]
+		more = true
+	}
+	if len(page) == 0 {
+		return nil, cursor, false
+	}
+	last := page[len(page)-1]
+	return resultValues(page), Cursor{started: true, distance: last.distance, key: last.value.key}, more
+}
+
+// SearchBanded returns up to perBand nearest values for every distance band, keyed by the index of the band.
+// The bands are given by their upper bounds in kilometers sorted ascending: band 0 contains the values up to
+// bandsKM[0], band i the values greater than bandsKM[i-1] up to bandsKM[i]. Bands without values are not
+// contained in the result. The search stops once all bands are full or the distance exceeds the last band.
+func (a *KNN[T]) SearchBanded(ctx context.Context, lat float64, long float64, bandsKM []float64, perBand int) map[int][]*Value[T] {
+	result := make(map[int][]*Value[T])
+	if len(bandsKM) == 0 || perBand <= 0 {
+		return result
+	}
+	s := a.newSearcher(lat, long)
+	s.limit = kmToChordAngle(bandsKM[len(bandsKM)-1])
+	full := 0
+	for full < len(bandsKM) {
+		value, distance, ok := s.next(ctx)
+		if !ok {
+			break
+		}
+		band, _ := slices.BinarySearch(bandsKM, chordAngleToKM(distance))
+		if band == len(bandsKM) || len(result[band]) >= perBand {
+			continue
+		}
+		result[band] = append(result[band], value)
+		if len(result[band]) == perBand {
+			full++
+		}
+	}
+	return result
+}
+
+// NearestPerSector divides the area around the given coordinates into sectors of equal angle, starting at north
+// and proceeding clockwise, and returns the nearest value of every sector. Sector i contains the bearings from
+// i*360/sectors up to (i+1)*360/sectors degrees. The slot of a sector without values is nil.
+// The function returns nil if sectors is not positive.
+func (a *KNN[T]) NearestPerSector(ctx context.Context, lat float64, long float64, sectors int) []*Value[T] {
+	if sectors <= 0 {
+		return nil
+	}
+	origin := s2.LatLngFromDegrees(lat, long)
+	result := make([]*Value[T], sectors)
+	filled := 0
+	s := a.newSearcher(lat, long)
+	for filled < sectors {
+		value, _, ok := s.next(ctx)
+		if !ok {
+			break
+		}
+		sector := min(int(bearingDeg(origin, value.cell.LatLng())*float64(sectors)/360), sectors-1)
+		if result[sector] == nil {
+			result[sector] = value
+			filled++
+		}
+	}
+	return result
+}
+
+// SearchClusteredAtLevel returns up to k values ordered by distance, with at most one value per cell at the
+// given level: the nearest value of the cell represents it. It serves non-overlapping map pins at a zoom level.
+// The function panics if the level is not a valid S2 level.
+func (a *KNN[T]) SearchClusteredAtLevel(ctx context.Context, lat float64, long float64, level int, k int) []*Value[T] {
+	validateLevel(level)
+	var result []*Value[T]
+	seen := make(map[s2.CellID]struct{})
+	s := a.newSearcher(lat, long)
+	for len(result) < k {
+		value, _, ok := s.next(ctx)
+		if !ok {
+			break
+		}
+		parent := value.cell.Parent(level)
+		if _, ok := seen[parent]; ok {
+			continue
+		}
+		seen[parent] = struct{}{}
+		result = append(result, value)
+	}
+	return result
+}
+
+// MeasureRecall measures the quality of the approximate search, as run by Query with WithExact(false), which
+// returns all values of a leaf at the distance of the leaf. It runs the given number of searches at random
+// coordinates drawn from rng and returns the average recall@k, the share of the k nearest values of the exact
+// search which are also among the first k values of the approximate search.
+// It returns 1 if the index is empty or k or queries are not positive, because no value can be missed.
+func (a *KNN[T]) MeasureRecall(k int, queries int, rng *rand.Rand) float64 {
+	if k <= 0 || queries <= 0 {
+		return 1
+	}
+	ctx := context.Background()
+	var sum float64
+	var measured int
+	for range queries {
+		lat, long := -90+rng.Float64()*180, -180+rng.Float64()*360
+		exact := a.Query(ctx, lat, long, WithK[T](k))
+		if len(exact) == 0 {
+			continue
+		}
+		found := make(map[string]struct{}, len(exact))
+		for _, value := range a.Query(ctx, lat, long, WithK[T](k), WithExact[T](false)) {
+			found[value.key] = struct{}{}
+		}
+		hits := 0
+		for _, value := range exact {
+			if _, ok := found[value.key]; ok {
+				hits++
 			}
 		}
+		sum += float64(hits) / float64(len(exact))
+		measured++
+	}
+	if measured == 0 {
+		return 1
+	}
+	return sum / float64(measured)
+}
+
+// CountMatchingWithinRadius returns the number of values within the radius in kilometers for which match
+// returns true. The values are counted during the search, no result slice is allocated.
+func (a *KNN[T]) CountMatchingWithinRadius(ctx context.Context, lat float64, long float64, radiusKM float64, match func(*Value[T]) bool) int {
+	s := a.newSearcher(lat, long)
+	s.limit = kmToChordAngle(radiusKM)
+	count := 0
+	for {
+		value, _, ok := s.next(ctx)
+		if !ok {
+			return count
+		}
+		if match(value) {
+			count++
+		}
+	}
+}
+
+// CheckConsistency returns the sorted ids whose lookup entry points to a node which doesn't contain a value
+// with the id. The lookup map is expected to be consistent, so any returned id indicates a bug in the code
+// maintaining it, e.g. in node splits or removes. Ids of values evicted to a node store are not checked.
+func (a *KNN[T]) CheckConsistency() []string {
+	a.lookupMutex.RLock()
+	defer a.lookupMutex.RUnlock()
+	var inconsistent []string
+	for id, node := range a.lookup {
+		if !node.isSpilled() && node.FindValue(id) == nil {
+			inconsistent = append(inconsistent, id)
+		}
 	}
+	slices.Sort(inconsistent)
+	return inconsistent
 }
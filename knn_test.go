@@ -1,11 +1,23 @@
 package go_sknn
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"encoding/json"
+	"maps"
+	"math"
 	"math/rand"
+	"runtime"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unsafe"
 
+	"github.com/golang/geo/s1"
 	"github.com/golang/geo/s2"
 	"github.com/stretchr/testify/assert"
 )
@@ -93,6 +105,25 @@ func Test_KNN_AddValue_Panic(t *testing.T) {
 	index.AddValue("4", 2, 0, -180)
 }
 
+func Test_KNN_TryAddValue(t *testing.T) {
+	index, err := NewKNN[int](10)
+	assert.NoError(t, err)
+
+	assert.EqualError(t, index.TryAddValue("1", 1, 0, 181), "invalid latitude 0.000000 (Min:-90, Max 90) or longitude 181.000000 (Min: -180, Max 180)")
+	assert.EqualError(t, index.TryAddValue("1", 1, -91, 0), "invalid latitude -91.000000 (Min:-90, Max 90) or longitude 0.000000 (Min: -180, Max 180)")
+	assert.False(t, index.HasValue("1"))
+	assert.NoError(t, index.TryAddValue("1", 1, 51.0504, 13.7373))
+	assert.True(t, index.HasValue("1"))
+
+	// An invalid upsert leaves the existing value unchanged.
+	assert.EqualError(t, index.TryUpsertValue("1", 2, 91, 0), "invalid latitude 91.000000 (Min:-90, Max 90) or longitude 0.000000 (Min: -180, Max 180)")
+	assert.Equal(t, 1, index.findValue("1").Value())
+	assert.NoError(t, index.TryUpsertValue("1", 2, 52.5200, 13.4050))
+	assert.Equal(t, 2, index.findValue("1").Value())
+	assert.Panics(t, func() { index.UpsertValue("1", 3, 0, -181) })
+	assert.Equal(t, 2, index.findValue("1").Value())
+}
+
 func Test_KNN_RemoveValue(t *testing.T) {
 	index, err := NewKNN[int](5)
 	assert.NoError(t, err)
@@ -113,6 +144,131 @@ func Test_KNN_RemoveValue(t *testing.T) {
 	assert.Len(t, index.lookup, 0)
 }
 
+func Test_KNN_AddValue_ExistingID(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	for i := range 100 {
+		index.AddValue(strconv.Itoa(i), i, RandLat(r), RandLong(r))
+	}
+	index.AddValue("x", 1, 51.0504, 13.7373)
+	index.AddValue("x", 2, 52.5200, 13.4050)
+
+	found := 0
+	index.Search(context.Background(), 51.0504, 13.7373, func(value *Value[int]) bool {
+		if value.Key() == "x" {
+			found++
+			assert.Equal(t, 2, value.Value())
+		}
+		return false
+	})
+	assert.Equal(t, 1, found)
+	assert.Equal(t, 101, index.Count())
+	assert.Empty(t, index.ValuesAt(51.0504, 13.7373, 1))
+
+	assert.True(t, index.RemoveValue("x"))
+	assert.Equal(t, 100, index.Count())
+}
+
+func Test_KNN_Len(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	assert.Zero(t, index.Len())
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		r := rand.New(rand.NewSource(1))
+		for i := range 1_000 {
+			index.AddValue(strconv.Itoa(i), i, RandLat(r), RandLong(r))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for range 1_000 {
+			assert.LessOrEqual(t, index.Len(), 1_000)
+		}
+	}()
+	wg.Wait()
+	assert.Equal(t, 1_000, index.Len())
+	assert.Equal(t, index.Count(), index.Len())
+
+	index.RemoveValue("1")
+	index.UpsertValue("2", 2, 1, 1)
+	assert.Equal(t, 999, index.Len())
+}
+
+func Test_KNN_GetValue(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	index.AddValue("1", 1, 51.0504, 13.7373)
+
+	value, ok := index.GetValue("1")
+	assert.True(t, ok)
+	assert.Equal(t, 1, value)
+	lat, long, ok := index.GetLocation("1")
+	assert.True(t, ok)
+	assert.InDelta(t, 51.0504, lat, 1e-7)
+	assert.InDelta(t, 13.7373, long, 1e-7)
+
+	index.UpsertValue("1", 2, 52.5200, 13.4050)
+	value, _ = index.GetValue("1")
+	assert.Equal(t, 2, value)
+	lat, long, _ = index.GetLocation("1")
+	assert.InDelta(t, 52.52, lat, 1e-7)
+	assert.InDelta(t, 13.405, long, 1e-7)
+
+	index.RemoveValue("1")
+	value, ok = index.GetValue("1")
+	assert.False(t, ok)
+	assert.Zero(t, value)
+	_, _, ok = index.GetLocation("1")
+	assert.False(t, ok)
+}
+
+func Test_KNN_RemoveValue_Unknown(t *testing.T) {
+	for _, opts := range [][]Option[int]{nil, {WithValueSlabs[int]()}} {
+		index, err := NewKNN[int](14, opts...)
+		assert.NoError(t, err)
+		r := rand.New(rand.NewSource(1))
+		for i := range 1_000 {
+			index.AddValue(strconv.Itoa(i), i, RandLat(r), RandLong(r))
+		}
+		lookup := maps.Clone(index.lookup)
+		fingerprint := index.Fingerprint()
+
+		// Removing an unknown id changes neither the lookup map nor the tree.
+		assert.False(t, index.RemoveValue("unknown"))
+		assert.Equal(t, lookup, index.lookup)
+		assert.Equal(t, fingerprint, index.Fingerprint())
+		assert.Equal(t, 1_000, index.Count())
+
+		// Removing an id twice only removes it once.
+		assert.True(t, index.RemoveValue("1"))
+		delete(lookup, "1")
+		fingerprint = index.Fingerprint()
+		assert.False(t, index.RemoveValue("1"))
+		assert.Equal(t, lookup, index.lookup)
+		assert.Equal(t, fingerprint, index.Fingerprint())
+		assert.Equal(t, 999, index.Count())
+
+		// Removing all remaining values removes the first, a middle and the last value of the nodes,
+		// down to the only value of a node.
+		for i := range 1_000 {
+			id := strconv.Itoa(i)
+			if id == "1" {
+				continue
+			}
+			assert.Equal(t, id, index.lookup[id].FindValue(id).Key())
+			assert.True(t, index.RemoveValue(id))
+			assert.False(t, index.HasValue(id))
+		}
+		assert.Zero(t, index.Count())
+		assert.Empty(t, index.lookup)
+	}
+}
+
 func Test_KNN_SearchApproximate_Partial(t *testing.T) {
 	objectCount := 2_000_000
 	index, err := NewKNN[int](25)
@@ -135,7 +291,7 @@ func Test_KNN_SearchApproximate_Partial(t *testing.T) {
 	index.SearchApproximate(context.Background(), searchLat, searchLong, filter)
 	prev := 0.0
 	for i := range results {
-		dist := float64(s2.CellFromCellID(results[i].cell).Distance(searchLocation))
+		dist := float64(results[i].Cell().Distance(searchLocation))
 		assert.True(t, prev <= dist, "prev: %f, dist: %f", prev, dist)
 		prev = dist
 	}
@@ -164,10 +320,41 @@ func Test_KNN_SearchApproximate_Full(t *testing.T) {
 	index.SearchApproximate(context.Background(), searchLat, searchLong, filter)
 	prev := 0.0
 	for i := range results {
-		dist := float64(s2.CellFromCellID(results[i].cell).Distance(searchLocation))
+		dist := float64(results[i].Cell().Distance(searchLocation))
+		assert.True(t, prev <= dist, "prev: %f, dist: %f", prev, dist)
+		prev = dist
+	}
+}
+
+func Test_KNN_SearchApproximate_LowPrecision(t *testing.T) {
+	objectCount := 10_000
+	index, err := NewKNN[int](1)
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+
+	searchLat, searchLong := 51.44, 13.55
+	searchLocation := s2.PointFromLatLng(s2.LatLngFromDegrees(searchLat, searchLong))
+
+	for i := range objectCount {
+		index.AddValue(strconv.Itoa(i), i, RandLat(r), RandLong(r))
+	}
+	// Almost all values are in a few huge leaves at level 1.
+	assert.Greater(t, slices.Max(index.indexRoot.ValuesCount()), objectCount/50)
+
+	var results []*Value[int]
+	filter := func(current *Value[int]) bool {
+		results = append(results, current)
+		return len(results) >= 1_000
+	}
+
+	index.SearchApproximate(context.Background(), searchLat, searchLong, filter)
+	prev := 0.0
+	for i := range results {
+		dist := float64(results[i].Cell().Distance(searchLocation))
 		assert.True(t, prev <= dist, "prev: %f, dist: %f", prev, dist)
 		prev = dist
 	}
+	assert.Len(t, results, 1_000)
 }
 
 func Test_KNN_Search_Full(t *testing.T) {
@@ -193,8 +380,2388 @@ func Test_KNN_Search_Full(t *testing.T) {
 
 	prev := 0.0
 	for i := range results {
-		dist := float64(s2.CellFromCellID(results[i].cell).Distance(searchLocation))
+		dist := float64(results[i].Cell().Distance(searchLocation))
 		assert.True(t, prev <= dist, "prev: %f, dist: %f", prev, dist)
 		prev = dist
 	}
 }
+
+func Test_KNN_SearchWithinRadiusKM(t *testing.T) {
+	items := randomItems(10_000)
+	index, err := BuildConcurrent(14, items, 1)
+	assert.NoError(t, err)
+	searchLat, searchLong := 51.44, 13.55
+
+	for _, radiusKM := range []float64{0, 300, 1_000} {
+		expected := 0
+		for _, item := range items {
+			if DistanceKM(searchLat, searchLong, item.Lat, item.Long) <= radiusKM {
+				expected++
+			}
+		}
+		var result []*Value[int]
+		index.SearchWithinRadiusKM(context.Background(), searchLat, searchLong, radiusKM, func(value *Value[int]) bool {
+			result = append(result, value)
+			return false
+		})
+		assert.Len(t, result, expected, "radius: %f", radiusKM)
+		prev := 0.0
+		for _, value := range result {
+			distance := value.DistanceKM(searchLat, searchLong)
+			assert.LessOrEqual(t, distance, radiusKM)
+			assert.LessOrEqual(t, prev, distance)
+			prev = distance
+		}
+	}
+
+	// The search stops when the callback returns true.
+	count := 0
+	index.SearchWithinRadiusKM(context.Background(), searchLat, searchLong, 1_000, func(*Value[int]) bool {
+		count++
+		return count == 3
+	})
+	assert.Equal(t, 3, count)
+}
+
+func Test_KNN_SearchInto(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	for i := range 1_000 {
+		index.AddValue(strconv.Itoa(i), i, RandLat(r), RandLong(r))
+	}
+
+	var expected []*Value[int]
+	index.Search(context.Background(), 51.44, 13.55, func(value *Value[int]) bool {
+		expected = append(expected, value)
+		return len(expected) >= 10
+	})
+
+	buf := make([]*Value[int], 0, 10)
+	buf = index.SearchInto(context.Background(), 51.44, 13.55, buf)
+	assert.Equal(t, expected, buf)
+	assert.Equal(t, 10, cap(buf))
+
+	// Reusing the buffer must not grow it.
+	buf = index.SearchInto(context.Background(), 51.44, 13.55, buf[:0])
+	assert.Equal(t, expected, buf)
+	assert.Equal(t, 10, cap(buf))
+
+	// A buffer without capacity returns no values.
+	assert.Len(t, index.SearchInto(context.Background(), 51.44, 13.55, nil), 0)
+}
+
+func Test_KNN_EstimateSearchCost(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	for i := range 200_000 {
+		index.AddValue(strconv.Itoa(i), i, RandLat(r), RandLong(r))
+	}
+
+	for _, k := range []int{1, 10, 100, 1000} {
+		for range 20 {
+			lat, long := RandLat(r), RandLong(r)
+			results := 0
+			metrics := index.SearchWithMetrics(context.Background(), lat, long, func(*Value[int]) bool {
+				results++
+				return results >= k
+			})
+			actual := metrics.NodesVisited + metrics.ValuesVisited
+			estimate := index.EstimateSearchCost(lat, long, k)
+			t.Logf("k: %d, actual: %d, estimate: %d", k, actual, estimate)
+			assert.LessOrEqual(t, estimate, actual*8, "k: %d", k)
+			assert.GreaterOrEqual(t, estimate*8, actual, "k: %d", k)
+		}
+	}
+}
+
+func Test_KNN_LatencyStats(t *testing.T) {
+	index, err := NewKNN[int](14, WithLatencyTracking[int]())
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	for i := range 1_000 {
+		index.AddValue(strconv.Itoa(i), i, RandLat(r), RandLong(r))
+	}
+	assert.Equal(t, LatencyStat{}, index.LatencyStats())
+
+	for range 500 {
+		index.Search(context.Background(), RandLat(r), RandLong(r), func(*Value[int]) bool { return true })
+		index.SearchApproximate(context.Background(), RandLat(r), RandLong(r), func(*Value[int]) bool { return true })
+	}
+
+	stats := index.LatencyStats()
+	assert.Equal(t, 1_000, stats.Count)
+	assert.Greater(t, stats.P50, time.Duration(0))
+	assert.LessOrEqual(t, stats.P50, stats.P95)
+	assert.LessOrEqual(t, stats.P95, stats.P99)
+}
+
+func Test_KNN_LatencyStats_Disabled(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	index.AddValue("1", 1, 1, 1)
+	index.Search(context.Background(), 0, 0, intFilter)
+	assert.Equal(t, LatencyStat{}, index.LatencyStats())
+}
+
+func Test_KNN_Transform(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	for i := range 100 {
+		index.AddValue(strconv.Itoa(i), i, -60+r.Float64()*120, -150+r.Float64()*300)
+	}
+
+	keys := func(lat, long float64) []string {
+		var result []string
+		index.Search(context.Background(), lat, long, func(value *Value[int]) bool {
+			result = append(result, value.Key())
+			return len(result) >= 10
+		})
+		return result
+	}
+
+	before := keys(10, 20)
+	// Shift all points 15 degrees to the east.
+	index.Transform(func(lat, long float64) (float64, float64) {
+		return lat, long + 15
+	})
+	assert.Len(t, index.lookup, 100)
+	assert.Equal(t, before, keys(10, 35))
+
+	// An invalid transformation leaves the index unchanged.
+	assert.Panics(t, func() {
+		index.Transform(func(lat, long float64) (float64, float64) {
+			return lat, long + 100
+		})
+	})
+	assert.Equal(t, before, keys(10, 35))
+}
+
+func Test_KNN_Transform_ConcurrentSearch(t *testing.T) {
+	index, err := BuildConcurrent(14, randomItems(1_000), 1)
+	assert.NoError(t, err)
+
+	// Searches see either the old or the transformed index, so they always find all requested values. Run with -race.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 20 {
+			// Mirror all values at the equator.
+			index.Transform(func(lat, long float64) (float64, float64) {
+				return -lat, long
+			})
+		}
+	}()
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 200 {
+				assert.Len(t, index.KNearest(context.Background(), 51.0504, 13.7373, 10), 10)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1_000, index.Len())
+	assert.Empty(t, index.CheckConsistency())
+}
+
+func Test_KNN_Clear(t *testing.T) {
+	index, err := BuildConcurrent(14, randomItems(1_000), 1, WithValueSlabs[int]())
+	assert.NoError(t, err)
+	before := index.KNearest(context.Background(), 51.0504, 13.7373, 10)
+	expected := make([]string, len(before))
+	for i, value := range before {
+		expected[i] = value.Key()
+	}
+
+	// Concurrent searches see either the old or the empty index.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r := rand.New(rand.NewSource(1))
+		for range 200 {
+			count := len(index.KNearest(context.Background(), RandLat(r), RandLong(r), 10))
+			assert.True(t, count == 0 || count == 10, "count: %d", count)
+		}
+	}()
+	index.Clear()
+	wg.Wait()
+
+	assert.Zero(t, index.Len())
+	assert.Zero(t, index.Count())
+	assert.Empty(t, index.KNearest(context.Background(), 0, 0, 10))
+	assert.Equal(t, 14, index.precision)
+	// Values returned before are still valid.
+	for i, value := range before {
+		assert.Equal(t, expected[i], value.Key())
+	}
+
+	// The index can be reused.
+	index.AddValue("1", 1, 51.0504, 13.7373)
+	assert.Equal(t, 1, index.Count())
+	assert.Equal(t, "1", index.KNearest(context.Background(), 0, 0, 10)[0].Key())
+}
+
+func Test_KNN_SearchWithPeek(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	for i := range 10_000 {
+		index.AddValue(strconv.Itoa(i), i, RandLat(r), RandLong(r))
+	}
+
+	searchLat, searchLong, radius := 51.44, 13.55, 1_000.0
+	inside, peek := index.SearchWithPeek(context.Background(), searchLat, searchLong, radius)
+	assert.NotEmpty(t, inside)
+	assert.NotNil(t, peek)
+
+	// Compare against a brute force search over all values.
+	var expectedInside int
+	var expectedPeek *Value[int]
+	for _, value := range index.indexRoot.CollectValues(nil) {
+		distance := value.DistanceKM(searchLat, searchLong)
+		if distance <= radius {
+			expectedInside++
+			continue
+		}
+		if expectedPeek == nil || distance < expectedPeek.DistanceKM(searchLat, searchLong) {
+			expectedPeek = value
+		}
+	}
+	assert.Len(t, inside, expectedInside)
+	assert.Equal(t, expectedPeek, peek)
+	for _, value := range inside {
+		assert.LessOrEqual(t, value.DistanceKM(searchLat, searchLong), radius)
+	}
+
+	// Without values outside the radius, peek is nil.
+	inside, peek = index.SearchWithPeek(context.Background(), searchLat, searchLong, 30_000)
+	assert.Len(t, inside, 10_000)
+	assert.Nil(t, peek)
+}
+
+func Test_KNN_UpdatePayload(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	index.AddValue("1", 1, 1, 1)
+	index.AddValue("2", 2, 2, 2)
+
+	assert.True(t, index.UpdatePayload("1", 10))
+	assert.False(t, index.UpdatePayload("3", 30))
+
+	var results []*Value[int]
+	index.Search(context.Background(), 1, 1, func(value *Value[int]) bool {
+		results = append(results, value)
+		return false
+	})
+	assert.Len(t, results, 2)
+	assert.Equal(t, "1", results[0].Key())
+	assert.Equal(t, 10, results[0].Value())
+	assert.Equal(t, s2.CellIDFromLatLng(s2.LatLngFromDegrees(1, 1)), results[0].CellID())
+	assert.Equal(t, 2, results[1].Value())
+	assert.False(t, index.HasValue("3"))
+}
+
+func Test_KNN_FillRatioByLevel(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	// Cluster all values around a single location.
+	for i := range 1_000 {
+		index.AddValue(strconv.Itoa(i), i, 51+r.Float64()*0.1, 13+r.Float64()*0.1)
+	}
+
+	ratios := index.FillRatioByLevel()
+	assert.Len(t, ratios, 15)
+	// All values are on a single face.
+	assert.Equal(t, 1.0/6, ratios[0])
+	for level := 1; level <= 14; level++ {
+		assert.LessOrEqual(t, ratios[level], ratios[level-1])
+	}
+	assert.Less(t, ratios[14], 0.000_001)
+
+	empty, err := NewKNN[int](3)
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]float64{0: 0, 1: 0, 2: 0, 3: 0}, empty.FillRatioByLevel())
+}
+
+func Test_KNN_UpsertValue_SameLocation(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	index.AddValue("1", 1, 51.0504, 13.7373)
+	index.AddValue("2", 2, 40.7128, 74.0060)
+
+	node := index.lookup["1"]
+	stored := node.FindValue("1")
+	assert.NotNil(t, stored)
+
+	index.UpsertValue("1", 10, 51.0504, 13.7373)
+	// The value was replaced by a copy in its node, the tree was not modified.
+	assert.Same(t, node, index.lookup["1"])
+	updated := node.FindValue("1")
+	assert.Equal(t, 10, updated.Value())
+	assert.Equal(t, stored.sequence, updated.sequence)
+	assert.Equal(t, s2.CellIDFromLatLng(s2.LatLngFromDegrees(51.0504, 13.7373)), updated.CellID())
+	// The value returned before the update is not modified.
+	assert.Equal(t, 1, stored.Value())
+
+	// Moving the value re-indexes it at the new location.
+	index.UpsertValue("1", 11, 0, 0)
+	moved := index.lookup["1"].FindValue("1")
+	assert.NotSame(t, updated, moved)
+	assert.Equal(t, 11, moved.Value())
+	assert.Equal(t, s2.CellIDFromLatLng(s2.LatLngFromDegrees(0, 0)), moved.CellID())
+	assert.Len(t, index.lookup, 2)
+
+	// Upserting an unknown id adds it.
+	index.UpsertValue("3", 3, 1, 1)
+	assert.True(t, index.HasValue("3"))
+}
+
+func Test_KNN_UpsertValue_RoundTrip(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	for i := range 100 {
+		lat, long := RandLat(r), RandLong(r)
+		id := strconv.Itoa(i)
+		index.AddValue(id, i, lat, long)
+		stored := index.lookup[id].FindValue(id)
+		// The stored cell is accurate enough to reproduce the coordinates within a centimeter.
+		assert.Less(t, stored.DistanceKM(lat, long), 0.000_01)
+		// Upserting at the same coordinates keeps the node and the insertion order of the value.
+		node := index.lookup[id]
+		index.UpsertValue(id, i+1, lat, long)
+		assert.Same(t, node, index.lookup[id])
+		assert.Equal(t, stored.sequence, node.FindValue(id).sequence)
+	}
+}
+
+func Test_KNN_UpsertValue_Repeated(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	index.AddValue("1", 1, 51.0504, 13.7373)
+
+	// Every upsert of an existing id takes and releases the lookup lock.
+	index.UpsertValue("1", 2, 51.0504, 13.7373)
+	index.UpsertValue("1", 3, 51.0504, 13.7373)
+	index.UpsertValue("1", 4, 52.5200, 13.4050)
+	index.UpsertValue("1", 5, 48.1351, 11.5820)
+	value, ok := index.GetValue("1")
+	assert.True(t, ok)
+	assert.Equal(t, 5, value)
+	assert.Equal(t, 1, index.Len())
+	assert.Equal(t, 1, index.Count())
+}
+
+func Test_KNN_UpsertValue_ConcurrentSearch(t *testing.T) {
+	index, err := BuildConcurrent(14, randomItems(1_000), 1)
+	assert.NoError(t, err)
+
+	// Writers move their own ids while readers search, run with -race to check the lock usage.
+	var wg sync.WaitGroup
+	for writer := range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(writer)))
+			for i := range 2_000 {
+				id := strconv.Itoa(writer + 2*(i%500))
+				index.UpsertValue(id, i, RandLat(r), RandLong(r))
+			}
+		}()
+	}
+	for reader := range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(10 + reader)))
+			for range 500 {
+				for _, value := range index.KNearest(context.Background(), RandLat(r), RandLong(r), 10) {
+					assert.NotEmpty(t, value.Key())
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1_000, index.Count())
+	assert.Empty(t, index.CheckConsistency())
+}
+
+func Test_KNN_UpsertValue_ConcurrentSplit(t *testing.T) {
+	index, err := NewKNN[int](20)
+	assert.NoError(t, err)
+	for i := range 4 {
+		index.AddValue(strconv.Itoa(i), 0, 48.137, 11.575+float64(i)*0.000_01)
+	}
+
+	// Adding values next to the upserted ones splits their leaves repeatedly, no upsert may be lost.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := range 1_000 {
+			index.AddValue("new-"+strconv.Itoa(i), i, 48.137+float64(i)*0.000_001, 11.575)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := range 1_000 {
+			index.UpsertValue(strconv.Itoa(i%4), i, 48.137, 11.575+float64(i%4)*0.000_01)
+		}
+	}()
+	wg.Wait()
+	for i := range 4 {
+		value, ok := index.GetValue(strconv.Itoa(i))
+		assert.True(t, ok)
+		assert.Equal(t, 996+i, value)
+	}
+	assert.Equal(t, 1_004, index.Len())
+	assert.Empty(t, index.CheckConsistency())
+}
+
+func Test_KNN_Search_ConcurrentSplit(t *testing.T) {
+	index, err := NewKNN[int](20)
+	assert.NoError(t, err)
+	for i := range 50 {
+		index.AddValue(strconv.Itoa(i), i, 48.137, 11.575+float64(i)*0.000_01)
+	}
+
+	// Adding values next to the existing ones splits their leaves repeatedly, no search may miss an existing value.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 2_000 {
+			index.AddValue("new-"+strconv.Itoa(i), i, 48.137+float64(i%100)*0.000_001, 11.575+float64(i%50)*0.000_01)
+		}
+	}()
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 200 {
+				found := map[string]bool{}
+				for _, value := range index.KNearest(context.Background(), 48.137, 11.575, 10_000) {
+					found[value.Key()] = true
+				}
+				for i := range 50 {
+					assert.True(t, found[strconv.Itoa(i)], "value %d is missing", i)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 2_050, index.Len())
+}
+
+func Test_KNN_UpdatePayload_ConcurrentSearch(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	for i := range 100 {
+		index.AddValue(strconv.Itoa(i), 0, 48.137, 11.575+float64(i)*0.000_1)
+	}
+
+	// Writers update the payloads in place while readers read the payloads of the found values. Run with -race.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 2_000 {
+			id := strconv.Itoa(i % 100)
+			index.UpsertValue(id, i, 48.137, 11.575+float64(i%100)*0.000_1)
+			index.UpdatePayload(id, -i)
+		}
+	}()
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 500 {
+				for _, value := range index.KNearest(context.Background(), 48.137, 11.575, 10) {
+					assert.GreaterOrEqual(t, value.Value(), -2_000)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for i := range 100 {
+		value, ok := index.GetValue(strconv.Itoa(i))
+		assert.True(t, ok)
+		assert.Equal(t, -(1_900 + i), value)
+	}
+}
+
+func Test_KNN_Search_ConcurrentWrites(t *testing.T) {
+	index, err := BuildConcurrent(14, randomItems(1_000), 1)
+	assert.NoError(t, err)
+
+	// Writers add and remove values, which splits and empties nodes, while readers search. Run with -race.
+	var wg sync.WaitGroup
+	for writer := range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(writer)))
+			for i := range 2_000 {
+				id := "new-" + strconv.Itoa(writer) + "-" + strconv.Itoa(i)
+				index.AddValue(id, i, RandLat(r), RandLong(r))
+				if i%2 == 0 {
+					index.RemoveValue(id)
+				}
+			}
+		}()
+	}
+	for reader := range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(10 + reader)))
+			for range 500 {
+				count := 0
+				search := func(value *Value[int]) bool {
+					assert.NotEmpty(t, value.Key())
+					count++
+					return count >= 10
+				}
+				index.Search(context.Background(), RandLat(r), RandLong(r), search)
+				count = 0
+				index.SearchApproximate(context.Background(), RandLat(r), RandLong(r), search)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 3_000, index.Count())
+	assert.Empty(t, index.CheckConsistency())
+}
+
+func Test_KNN_NearestInWindow(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	// Old values close to the search location.
+	index.AddValue("old-1", 1, 51.0504, 13.7373)
+	index.AddValue("old-2", 2, 51.0505, 13.7374)
+
+	time.Sleep(time.Millisecond)
+	since := time.Now()
+	time.Sleep(time.Millisecond)
+
+	// Recent values further away.
+	index.AddValue("new-1", 3, 52.5200, 13.4050)
+	index.AddValue("new-2", 4, 48.1351, 11.5820)
+
+	result := index.NearestInWindow(context.Background(), 51.0504, 13.7373, since, 1)
+	assert.Len(t, result, 1)
+	assert.Equal(t, "new-1", result[0].Key())
+	assert.False(t, result[0].AddedAt().Before(since))
+
+	result = index.NearestInWindow(context.Background(), 51.0504, 13.7373, since, 10)
+	assert.Len(t, result, 2)
+	assert.Equal(t, "new-1", result[0].Key())
+	assert.Equal(t, "new-2", result[1].Key())
+
+	result = index.NearestInWindow(context.Background(), 51.0504, 13.7373, time.Time{}, 10)
+	assert.Len(t, result, 4)
+	assert.Equal(t, "old-1", result[0].Key())
+}
+
+func Test_KNN_SearchTimeWindow(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	// Old values closest to the search location.
+	index.AddValue("old", 1, 51.0504, 13.7373)
+	time.Sleep(time.Millisecond)
+	from := time.Now()
+	time.Sleep(time.Millisecond)
+
+	// Values within the window further away.
+	index.AddValue("window-1", 2, 51.3397, 12.3731)
+	index.AddValue("window-2", 3, 52.5200, 13.4050)
+	time.Sleep(time.Millisecond)
+	to := time.Now()
+	time.Sleep(time.Millisecond)
+
+	// New values between the window values.
+	index.AddValue("new", 4, 52.2, 13.5)
+
+	keys := func(values []*Value[int]) []string {
+		result := make([]string, 0, len(values))
+		for _, value := range values {
+			result = append(result, value.Key())
+		}
+		return result
+	}
+	assert.Equal(t, []string{"window-1"}, keys(index.SearchTimeWindow(context.Background(), 51.0504, 13.7373, from, to, 1)))
+	assert.Equal(t, []string{"window-1", "window-2"}, keys(index.SearchTimeWindow(context.Background(), 51.0504, 13.7373, from, to, 10)))
+	assert.Equal(t, []string{"old", "window-1", "new", "window-2"}, keys(index.SearchTimeWindow(context.Background(), 51.0504, 13.7373, time.Time{}, time.Now(), 10)))
+	assert.Empty(t, index.SearchTimeWindow(context.Background(), 51.0504, 13.7373, to, from, 10))
+	assert.Empty(t, index.SearchTimeWindow(context.Background(), 51.0504, 13.7373, from, to, 0))
+}
+
+func Test_KNN_SearchWithDistance(t *testing.T) {
+	index, err := BuildConcurrent(14, randomItems(10_000), 1)
+	assert.NoError(t, err)
+	searchLat, searchLong := 51.44, 13.55
+
+	expected := index.KNearest(context.Background(), searchLat, searchLong, 100)
+	var actual []*Value[int]
+	index.SearchWithDistance(context.Background(), searchLat, searchLong, func(value *Value[int], distanceKM float64) bool {
+		actual = append(actual, value)
+		// The distance is measured to the leaf cell instead of its center.
+		assert.InDelta(t, value.DistanceKM(searchLat, searchLong), distanceKM, 1e-5)
+		return len(actual) >= 100
+	})
+	assert.Equal(t, expected, actual)
+}
+
+func Test_KNN_SearchWithLeafCell(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	for i := range 1_000 {
+		index.AddValue(strconv.Itoa(i), i, 51+r.Float64(), 13+r.Float64())
+	}
+
+	var expected []*Value[int]
+	index.Search(context.Background(), 51.5, 13.5, func(value *Value[int]) bool {
+		expected = append(expected, value)
+		return false
+	})
+
+	var results []*Value[int]
+	index.SearchWithLeafCell(context.Background(), 51.5, 13.5, func(value *Value[int], leafCell s2.CellID) bool {
+		results = append(results, value)
+		// The leaf cell is the cell of the node the value is stored in.
+		assert.Equal(t, index.lookup[value.Key()].cellID, leafCell)
+		return false
+	})
+	assert.Equal(t, expected, results)
+
+	// The values of an index which is not split yet are stored in the root, which has no cell.
+	small, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	small.AddValue("dresden", 1, 51.0504, 13.7373)
+	small.AddValue("sydney", 2, -33.8688, 151.2093)
+	assert.True(t, small.indexRoot.IsLeaveNode())
+	small.SearchWithLeafCell(context.Background(), 51.5, 13.5, func(value *Value[int], leafCell s2.CellID) bool {
+		assert.True(t, leafCell.IsValid())
+		assert.Equal(t, 0, leafCell.Level())
+		assert.True(t, leafCell.Contains(value.CellID()))
+		return false
+	})
+}
+
+func Test_KNN_Shard(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	for i := range 1_003 {
+		index.AddValue(strconv.Itoa(i), i, RandLat(r), RandLong(r))
+	}
+
+	shards := index.Shard(4)
+	assert.Len(t, shards, 4)
+
+	seen := make(map[string]bool)
+	var union []*Value[int]
+	for _, shard := range shards {
+		assert.InDelta(t, 250, len(shard.lookup), 1)
+		shard.Search(context.Background(), 51.44, 13.55, func(value *Value[int]) bool {
+			assert.False(t, seen[value.Key()], "value %s is in multiple shards", value.Key())
+			seen[value.Key()] = true
+			union = append(union, value)
+			return false
+		})
+	}
+	assert.Len(t, seen, 1_003)
+
+	// The merged search of the shards equals the search of the original index.
+	slices.SortStableFunc(union, func(lhs, rhs *Value[int]) int {
+		return cmp.Compare(lhs.DistanceKM(51.44, 13.55), rhs.DistanceKM(51.44, 13.55))
+	})
+	var expected []string
+	index.Search(context.Background(), 51.44, 13.55, func(value *Value[int]) bool {
+		expected = append(expected, value.Key())
+		return false
+	})
+	var actual []string
+	for _, value := range union {
+		actual = append(actual, value.Key())
+	}
+	assert.Equal(t, expected, actual)
+
+	assert.Nil(t, index.Shard(0))
+}
+
+func Test_KNN_WithMaxTreeDepth(t *testing.T) {
+	index, err := NewKNN[int](30, WithMaxTreeDepth[int](16))
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	// Dense data, which would split the tree down to the precision without a depth cap.
+	for i := range 10_000 {
+		index.AddValue(strconv.Itoa(i), i, 51+r.Float64()*0.001, 13+r.Float64()*0.001)
+	}
+
+	maxLevel := 0
+	var walk func(node *Node[int])
+	walk = func(node *Node[int]) {
+		maxLevel = max(maxLevel, node.Level())
+		for _, child := range node.children {
+			assert.Same(t, node, child.parent)
+			walk(child)
+		}
+		for _, value := range node.values {
+			// The values keep their full resolution cell.
+			assert.Equal(t, MaxPrecision, value.CellID().Level())
+			assert.True(t, node.cellID.Contains(value.CellID()) || node.parent == nil)
+			assert.Same(t, node, index.lookup[value.Key()])
+		}
+	}
+	walk(index.indexRoot)
+	assert.Equal(t, 16, maxLevel)
+
+	// The search is still ordered by distance.
+	prev := 0.0
+	index.Search(context.Background(), 51.0005, 13.0005, func(value *Value[int]) bool {
+		// Allow a centimeter of difference between the cell distance and the distance to the cell center.
+		dist := value.DistanceKM(51.0005, 13.0005)
+		assert.LessOrEqual(t, prev, dist+0.000_01)
+		prev = dist
+		return false
+	})
+
+	_, err = NewKNN[int](14, WithMaxTreeDepth[int](31))
+	assert.EqualError(t, err, "invalid max tree depth 31: depth must be between 0 and 30")
+}
+
+func Test_SearchFederated(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	for i := range 10_000 {
+		index.AddValue(strconv.Itoa(i), i, RandLat(r), RandLong(r))
+	}
+	shards := index.Shard(5)
+
+	keys := func(values []*Value[int]) []string {
+		result := make([]string, 0, len(values))
+		for _, value := range values {
+			result = append(result, value.Key())
+		}
+		return result
+	}
+
+	for _, k := range []int{1, 10, 100} {
+		var expected []*Value[int]
+		index.Search(context.Background(), 51.44, 13.55, func(value *Value[int]) bool {
+			expected = append(expected, value)
+			return len(expected) >= k
+		})
+		actual := SearchFederated(context.Background(), shards, 51.44, 13.55, k)
+		assert.Equal(t, keys(expected), keys(actual))
+	}
+
+	assert.Len(t, SearchFederated(context.Background(), shards, 51.44, 13.55, 20_000), 10_000)
+	assert.Empty(t, SearchFederated(context.Background(), shards, 51.44, 13.55, 0))
+	assert.Empty(t, SearchFederated[int](context.Background(), nil, 51.44, 13.55, 10))
+}
+
+func Test_KNN_SearchApproximateAtPrecision(t *testing.T) {
+	index, err := NewKNN[int](20)
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	for i := range 10_000 {
+		index.AddValue(strconv.Itoa(i), i, 50+r.Float64()*5, 10+r.Float64()*5)
+	}
+
+	searchLat, searchLong := 52.5, 12.5
+	point := s2.PointFromLatLng(s2.LatLngFromDegrees(searchLat, searchLong))
+	for _, precision := range []int{0, 5, 10, 20} {
+		seen := make(map[string]bool)
+		prev := 0.0
+		err := index.SearchApproximateAtPrecision(context.Background(), searchLat, searchLong, precision, func(value *Value[int]) bool {
+			seen[value.Key()] = true
+			// Values below the effective precision are ordered by the distance of their ancestor at that precision.
+			cell := value.CellID()
+			if index.lookup[value.Key()].Level() >= precision {
+				cell = cell.Parent(precision)
+			}
+			dist := float64(s2.CellFromCellID(cell).Distance(point))
+			assert.LessOrEqual(t, prev, dist, "precision: %d", precision)
+			prev = dist
+			return false
+		})
+		assert.NoError(t, err)
+		assert.Len(t, seen, 10_000)
+	}
+
+	var results []*Value[int]
+	err = index.SearchApproximateAtPrecision(context.Background(), searchLat, searchLong, 10, func(value *Value[int]) bool {
+		results = append(results, value)
+		return len(results) >= 10
+	})
+	assert.NoError(t, err)
+	assert.Len(t, results, 10)
+
+	err = index.SearchApproximateAtPrecision(context.Background(), searchLat, searchLong, 21, intFilter)
+	assert.EqualError(t, err, "invalid effective precision 21: precision must be between 0 and 20")
+	err = index.SearchApproximateAtPrecision(context.Background(), searchLat, searchLong, -1, intFilter)
+	assert.EqualError(t, err, "invalid effective precision -1: precision must be between 0 and 20")
+}
+
+func randomItems(count int) []Item[int] {
+	r := rand.New(rand.NewSource(1))
+	items := make([]Item[int], count)
+	for i := range items {
+		items[i] = Item[int]{ID: strconv.Itoa(i), Value: i, Lat: RandLat(r), Long: RandLong(r)}
+	}
+	return items
+}
+
+func Test_BuildConcurrent(t *testing.T) {
+	items := randomItems(10_000)
+	// The last item of a duplicate id wins.
+	items = append(items, Item[int]{ID: "0", Value: -1, Lat: 51.44, Long: 13.55})
+
+	index, err := BuildConcurrent(14, items, 4)
+	assert.NoError(t, err)
+	serial, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	for _, item := range items[1:] {
+		serial.AddValue(item.ID, item.Value, item.Lat, item.Long)
+	}
+	assert.Len(t, index.lookup, 10_000)
+	for id, node := range index.lookup {
+		assert.NotNil(t, node.FindValue(id))
+	}
+
+	var expected, actual []*Value[int]
+	serial.Search(context.Background(), 51.44, 13.55, func(value *Value[int]) bool {
+		expected = append(expected, value)
+		return len(expected) >= 100
+	})
+	index.Search(context.Background(), 51.44, 13.55, func(value *Value[int]) bool {
+		actual = append(actual, value)
+		return len(actual) >= 100
+	})
+	assert.Len(t, actual, 100)
+	for i := range expected {
+		assert.Equal(t, expected[i].Key(), actual[i].Key())
+		assert.Equal(t, expected[i].Value(), actual[i].Value())
+	}
+	assert.Equal(t, -1, actual[0].Value())
+
+	// The built index can be modified like any other index.
+	index.AddValue("new", 1, 0, 0)
+	assert.True(t, index.RemoveValue("new"))
+
+	_, err = BuildConcurrent(14, []Item[int]{{ID: "1", Lat: 91}}, 4)
+	assert.EqualError(t, err, "item 1: invalid latitude 91.000000 (Min:-90, Max 90) or longitude 0.000000 (Min: -180, Max 180)")
+	_, err = BuildConcurrent(31, items, 4)
+	assert.Error(t, err)
+}
+
+func Test_KNN_BuildParallel(t *testing.T) {
+	items := randomItems(10_000)
+	expected, err := BuildConcurrent(14, items, 4, WithValueSlabs[int]())
+	assert.NoError(t, err)
+	index, err := NewKNN[int](14, WithValueSlabs[int]())
+	assert.NoError(t, err)
+	index.BuildParallel(items, 4)
+
+	assert.Equal(t, expected.Stats(), index.Stats())
+	assert.Empty(t, index.CheckConsistency())
+	// The configuration of the index is kept.
+	assert.True(t, index.indexRoot.children[0].useSlab)
+	r := rand.New(rand.NewSource(2))
+	for range 20 {
+		lat, long := RandLat(r), RandLong(r)
+		var expectedKeys, actualKeys []string
+		for _, value := range expected.KNearest(context.Background(), lat, long, 20) {
+			expectedKeys = append(expectedKeys, value.Key())
+		}
+		for _, value := range index.KNearest(context.Background(), lat, long, 20) {
+			actualKeys = append(actualKeys, value.Key())
+		}
+		assert.Equal(t, expectedKeys, actualKeys)
+	}
+
+	assert.PanicsWithValue(t, "BuildParallel requires an empty index", func() { index.BuildParallel(items, 4) })
+	empty, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	assert.Panics(t, func() { empty.BuildParallel([]Item[int]{{ID: "1", Lat: 91}}, 4) })
+	assert.Zero(t, empty.Len())
+}
+
+func Benchmark_AddValue(b *testing.B) {
+	items := randomItems(500_000)
+	b.ResetTimer()
+	for range b.N {
+		index, _ := NewKNN[int](14)
+		for _, item := range items {
+			index.AddValue(item.ID, item.Value, item.Lat, item.Long)
+		}
+	}
+}
+
+func Benchmark_AddValues(b *testing.B) {
+	items := randomItems(500_000)
+	b.ResetTimer()
+	for range b.N {
+		index, _ := NewKNN[int](14)
+		index.AddValues(items)
+	}
+}
+
+func Test_KNN_AddValues(t *testing.T) {
+	var wal bytes.Buffer
+	index, err := NewKNN[int](14, WithWAL[int](&wal))
+	assert.NoError(t, err)
+	// The tree of an empty index is built at once, so it equals the tree of a Builder.
+	builder, err := NewBuilder[int](14)
+	assert.NoError(t, err)
+	items := randomItems(10_000)
+	for _, item := range items {
+		builder.Add(item.ID, item.Value, item.Lat, item.Long)
+	}
+	// The last item of an id is kept.
+	items = append(items, Item[int]{ID: "0", Value: -1, Lat: 10, Long: 10})
+	builder.Add("0", -1, 10, 10)
+	expected := builder.Build()
+	index.AddValues(items)
+	assert.Equal(t, expected.Len(), index.Len())
+	assert.Equal(t, expected.Stats(), index.Stats())
+	assert.Empty(t, index.CheckConsistency())
+	value, ok := index.GetValue("0")
+	assert.True(t, ok)
+	assert.Equal(t, -1, value)
+
+	// Values are added to a filled index as usual.
+	index.AddValues([]Item[int]{{ID: "1", Value: -2, Lat: 20, Long: 20}, {ID: "new", Value: -3, Lat: 20, Long: 20}})
+	assert.Equal(t, 10_001, index.Len())
+	assert.ElementsMatch(t, []string{"1", "new"}, []string{
+		index.KNearest(context.Background(), 20, 20, 2)[0].Key(),
+		index.KNearest(context.Background(), 20, 20, 2)[1].Key(),
+	})
+
+	replayed, err := ReplayWAL[int](&wal, 14)
+	assert.NoError(t, err)
+	assert.Equal(t, index.Len(), replayed.Len())
+	for _, value := range index.KNearest(context.Background(), 0, 0, 100) {
+		stored, ok := replayed.GetValue(value.Key())
+		assert.True(t, ok)
+		assert.Equal(t, value.Value(), stored)
+	}
+
+	assert.PanicsWithValue(t, "item x: invalid latitude 91.000000 (Min:-90, Max 90) or longitude 0.000000 (Min: -180, Max 180)", func() {
+		index.AddValues([]Item[int]{{ID: "y", Lat: 0}, {ID: "x", Lat: 91}})
+	})
+	assert.False(t, index.HasValue("y"))
+	errs := index.TryAddValues([]Item[int]{{ID: "x", Lat: 91}, {ID: "y", Lat: 0}, {ID: "z", Long: 181}})
+	assert.Len(t, errs, 2)
+	assert.ErrorContains(t, errs[0], "item x")
+	assert.ErrorContains(t, errs[1], "item z")
+	assert.False(t, index.HasValue("y"))
+	assert.Nil(t, index.TryAddValues([]Item[int]{{ID: "y", Lat: 0}}))
+	assert.True(t, index.HasValue("y"))
+}
+
+func Benchmark_BuildConcurrent(b *testing.B) {
+	items := randomItems(500_000)
+	b.ResetTimer()
+	for range b.N {
+		_, _ = BuildConcurrent(14, items, 6)
+	}
+}
+
+func Test_KNN_WithCellCache(t *testing.T) {
+	items := randomItems(10_000)
+	cached, err := BuildConcurrent(14, items, 2, WithCellCache[int]())
+	assert.NoError(t, err)
+	uncached, err := BuildConcurrent(14, items, 2)
+	assert.NoError(t, err)
+
+	assert.NotNil(t, cached.indexRoot.children[0].cell)
+	assert.Nil(t, uncached.indexRoot.children[0].cell)
+
+	r := rand.New(rand.NewSource(2))
+	for range 100 {
+		lat, long := RandLat(r), RandLong(r)
+		var expected, actual []string
+		uncached.Search(context.Background(), lat, long, func(value *Value[int]) bool {
+			expected = append(expected, value.Key())
+			return len(expected) >= 20
+		})
+		cached.Search(context.Background(), lat, long, func(value *Value[int]) bool {
+			actual = append(actual, value.Key())
+			return len(actual) >= 20
+		})
+		assert.Equal(t, expected, actual)
+	}
+
+	// The shards keep the cache.
+	assert.NotNil(t, cached.Shard(2)[0].indexRoot.children[0].cell)
+}
+
+func benchmarkSearch(b *testing.B, opts ...Option[int]) {
+	index, _ := BuildConcurrent(14, randomItems(500_000), 1, opts...)
+	b.ResetTimer()
+	for range b.N {
+		count := 0
+		index.Search(context.Background(), 51.44, 13.55, func(*Value[int]) bool {
+			count++
+			return count >= 100
+		})
+	}
+}
+
+func Benchmark_Search(b *testing.B) {
+	benchmarkSearch(b)
+}
+
+func Benchmark_Search_CellCache(b *testing.B) {
+	benchmarkSearch(b, WithCellCache[int]())
+}
+
+func Test_KNN_KNearest(t *testing.T) {
+	index, err := BuildConcurrent(14, randomItems(1_000), 1)
+	assert.NoError(t, err)
+	searchLat, searchLong := 51.44, 13.55
+
+	var all []*Value[int]
+	index.Search(context.Background(), searchLat, searchLong, func(value *Value[int]) bool {
+		all = append(all, value)
+		return false
+	})
+	assert.Equal(t, all[:10], index.KNearest(context.Background(), searchLat, searchLong, 10))
+	// The index holds fewer values than requested.
+	assert.Equal(t, all, index.KNearest(context.Background(), searchLat, searchLong, 2_000))
+	assert.Empty(t, index.KNearest(context.Background(), searchLat, searchLong, 0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result := index.KNearest(ctx, searchLat, searchLong, 10)
+	assert.NotNil(t, result)
+	assert.Empty(t, result)
+}
+
+func Test_KNN_KNearestWithin(t *testing.T) {
+	index, err := BuildConcurrent(14, randomItems(10_000), 1)
+	assert.NoError(t, err)
+	searchLat, searchLong := 51.44, 13.55
+
+	var all []*Value[int]
+	index.Search(context.Background(), searchLat, searchLong, func(value *Value[int]) bool {
+		all = append(all, value)
+		return false
+	})
+
+	// The k limit is reached first.
+	result := index.KNearestWithin(context.Background(), searchLat, searchLong, 5, 10_000)
+	assert.Equal(t, all[:5], result)
+
+	// The radius is reached first.
+	radius := all[20].DistanceKM(searchLat, searchLong) - 0.001
+	result = index.KNearestWithin(context.Background(), searchLat, searchLong, 100, radius)
+	assert.Equal(t, all[:20], result)
+	for _, value := range result {
+		assert.LessOrEqual(t, value.DistanceKM(searchLat, searchLong), radius)
+	}
+
+	assert.Empty(t, index.KNearestWithin(context.Background(), searchLat, searchLong, 0, 10_000))
+	assert.Empty(t, index.KNearestWithin(context.Background(), searchLat, searchLong, 10, 0))
+}
+
+func Test_KNN_ValuesOutside(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	// Values inside the region from 50N 10E to 54N 15E.
+	for i := range 1_000 {
+		index.AddValue("in-"+strconv.Itoa(i), i, 50.5+r.Float64()*3, 10.5+r.Float64()*4)
+	}
+	index.AddValue("out-1", 1, 48, 11)
+	index.AddValue("out-2", 2, 52, 20)
+	index.AddValue("out-3", 3, -33.8688, 151.2093)
+
+	// The vertices of the loop are ordered counterclockwise.
+	region := s2.LoopFromPoints([]s2.Point{
+		s2.PointFromLatLng(s2.LatLngFromDegrees(50, 10)),
+		s2.PointFromLatLng(s2.LatLngFromDegrees(50, 15)),
+		s2.PointFromLatLng(s2.LatLngFromDegrees(54, 15)),
+		s2.PointFromLatLng(s2.LatLngFromDegrees(54, 10)),
+	})
+
+	var keys []string
+	for _, value := range index.ValuesOutside(region) {
+		keys = append(keys, value.Key())
+	}
+	assert.ElementsMatch(t, []string{"out-1", "out-2", "out-3"}, keys)
+}
+
+func Test_KNN_NearestExcludingRegion(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	// A dense cluster inside the region from 50N 10E to 54N 15E around the search location.
+	for i := range 1_000 {
+		index.AddValue("in-"+strconv.Itoa(i), i, 51.5+r.Float64(), 12+r.Float64())
+	}
+	index.AddValue("out-1", 1, 48, 11)
+	index.AddValue("out-2", 2, 52, 20)
+	index.AddValue("out-3", 3, -33.8688, 151.2093)
+	region := s2.LoopFromPoints([]s2.Point{
+		s2.PointFromLatLng(s2.LatLngFromDegrees(50, 10)),
+		s2.PointFromLatLng(s2.LatLngFromDegrees(50, 15)),
+		s2.PointFromLatLng(s2.LatLngFromDegrees(54, 15)),
+		s2.PointFromLatLng(s2.LatLngFromDegrees(54, 10)),
+	})
+
+	keys := func(values []*Value[int]) []string {
+		result := make([]string, 0, len(values))
+		for _, value := range values {
+			result = append(result, value.Key())
+		}
+		return result
+	}
+	assert.Equal(t, []string{"out-1", "out-2"}, keys(index.NearestExcludingRegion(context.Background(), 52, 12.5, region, 2)))
+	assert.Equal(t, []string{"out-1", "out-2", "out-3"}, keys(index.NearestExcludingRegion(context.Background(), 52, 12.5, region, 10)))
+	// Without the exclusion the cluster is nearer.
+	assert.Equal(t, "in-", index.NearestExcludingRegion(context.Background(), 52, 12.5, s2.EmptyLoop(), 1)[0].Key()[:3])
+}
+
+func Test_KNN_SearchApproximateWithOrdering(t *testing.T) {
+	index, err := NewKNN[int](10)
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	for i := range 10_000 {
+		index.AddValue(strconv.Itoa(i), i, 50+r.Float64()*5, 10+r.Float64()*5)
+	}
+
+	searchLat, searchLong := 52.5, 12.5
+	point := s2.PointFromLatLng(s2.LatLngFromDegrees(searchLat, searchLong))
+	ringWidth := index.ringWidthKM()
+	seen := make(map[string]bool)
+	prevRing := 0.0
+	index.SearchApproximateWithOrdering(context.Background(), searchLat, searchLong, OrderRings, func(value *Value[int]) bool {
+		seen[value.Key()] = true
+		// The values are grouped by the ring of their leaf.
+		leafDistance := chordAngleToKM(index.lookup[value.Key()].Distance(point))
+		ring := math.Floor(leafDistance / ringWidth)
+		assert.LessOrEqual(t, prevRing, ring)
+		prevRing = ring
+		return false
+	})
+	assert.Len(t, seen, 10_000)
+	assert.Greater(t, prevRing, 10.0)
+
+	var expected, actual []*Value[int]
+	index.SearchApproximate(context.Background(), searchLat, searchLong, func(value *Value[int]) bool {
+		expected = append(expected, value)
+		return false
+	})
+	index.SearchApproximateWithOrdering(context.Background(), searchLat, searchLong, OrderBestFirst, func(value *Value[int]) bool {
+		actual = append(actual, value)
+		return false
+	})
+	assert.Equal(t, expected, actual)
+}
+
+func Test_KNN_PruneableNodes(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	for i := range 100 {
+		index.AddValue("dresden-"+strconv.Itoa(i), i, 51+r.Float64()*0.01, 13.7+r.Float64()*0.01)
+	}
+	index.AddValue("sydney", 1, -33.8688, 151.2093)
+	assert.Equal(t, 0, index.PruneableNodes())
+
+	// Only the face of Sydney and the root remain after removing all values in Dresden.
+	for i := range 100 {
+		assert.True(t, index.RemoveValue("dresden-"+strconv.Itoa(i)))
+	}
+	assert.Equal(t, 0, index.PruneableNodes())
+	nodes, values := index.indexRoot.SubtreeCount()
+	assert.Equal(t, 2, nodes)
+	assert.Equal(t, 1, values)
+
+	// Empty nodes created otherwise are removed by Prune.
+	sydneyFace := s2.CellIDFromLatLng(s2.LatLngFromDegrees(-33.8688, 151.2093)).Face()
+	emptyFace := s2.CellIDFromFace((sydneyFace + 1) % 6)
+	emptyChild := index.indexRoot.GetOrCreateChild(emptyFace).GetOrCreateChild(emptyFace.Children()[0])
+	assert.Equal(t, 2, index.PruneableNodes())
+	index.Prune()
+	assert.Equal(t, 0, index.PruneableNodes())
+	// The removed nodes keep their parent, so a search still holding them reads their level.
+	assert.Equal(t, 1, emptyChild.Level())
+	assert.Equal(t, 0, emptyChild.parent.Level())
+	nodes, _ = index.indexRoot.SubtreeCount()
+	assert.Equal(t, 2, nodes)
+
+	// The pruned index still works.
+	var results []string
+	index.AddValue("dresden", 1, 51.05, 13.73)
+	index.Search(context.Background(), 51, 13, func(value *Value[int]) bool {
+		results = append(results, value.Key())
+		return false
+	})
+	assert.Equal(t, []string{"dresden", "sydney"}, results)
+
+	// Removing the last values leaves only the root.
+	index.RemoveValue("dresden")
+	index.RemoveValue("sydney")
+	assert.Equal(t, 0, index.PruneableNodes())
+	assert.Empty(t, index.indexRoot.children)
+}
+
+func Test_KNN_RemoveValue_PrunesEmptyNodes(t *testing.T) {
+	index, err := NewKNN[int](30)
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	for i := range 100 {
+		index.AddValue(strconv.Itoa(i), i, RandLat(r), RandLong(r))
+	}
+	nodes := index.NodeCount()
+
+	// Values at almost the same location are split into a deep branch.
+	for i := range maxValuesPerCell + 1 {
+		index.AddValue("deep-"+strconv.Itoa(i), i, 51.0504, 13.7373+float64(i)*0.000_000_1)
+	}
+	leaf := index.lookup["deep-0"]
+	assert.Greater(t, leaf.Level(), 20)
+	deepNodes := index.NodeCount()
+	assert.Greater(t, deepNodes, nodes+10)
+
+	// The branch collapses when its values are removed, and the nodes of other values are kept.
+	for i := range maxValuesPerCell + 1 {
+		assert.True(t, index.RemoveValue("deep-"+strconv.Itoa(i)))
+	}
+	assert.Nil(t, leaf.parent.ChildContaining(leaf.cellID))
+	assert.Less(t, index.NodeCount(), deepNodes-10)
+	assert.Equal(t, 100, index.Count())
+	for id, node := range index.lookup {
+		assert.NotNil(t, node.FindValue(id))
+	}
+	for i := range 100 {
+		index.RemoveValue(strconv.Itoa(i))
+	}
+	assert.Equal(t, 1, index.NodeCount())
+}
+
+func Test_Interleave(t *testing.T) {
+	shops, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	events, err := NewKNN[string](14)
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	for i := range 1_000 {
+		shops.AddValue("shop-"+strconv.Itoa(i), i, 50+r.Float64()*5, 10+r.Float64()*5)
+		events.AddValue("event-"+strconv.Itoa(i), strconv.Itoa(i), 50+r.Float64()*5, 10+r.Float64()*5)
+	}
+
+	searchLat, searchLong := 52.5, 12.5
+	var keys []string
+	var distances []float64
+	Interleave(context.Background(), searchLat, searchLong, shops, events, 100,
+		func(value *Value[int], distance float64) {
+			assert.InDelta(t, value.DistanceKM(searchLat, searchLong), distance, 0.000_01)
+			keys = append(keys, value.Key())
+			distances = append(distances, distance)
+		},
+		func(value *Value[string], distance float64) {
+			assert.InDelta(t, value.DistanceKM(searchLat, searchLong), distance, 0.000_01)
+			keys = append(keys, value.Key())
+			distances = append(distances, distance)
+		},
+	)
+	assert.Len(t, keys, 100)
+	assert.True(t, slices.IsSorted(distances))
+
+	// The merged results are the nearest values of both indexes.
+	type keyDistance struct {
+		key      string
+		distance float64
+	}
+	var all []keyDistance
+	for _, value := range shops.indexRoot.CollectValues(nil) {
+		all = append(all, keyDistance{value.Key(), value.DistanceKM(searchLat, searchLong)})
+	}
+	for _, value := range events.indexRoot.CollectValues(nil) {
+		all = append(all, keyDistance{value.Key(), value.DistanceKM(searchLat, searchLong)})
+	}
+	slices.SortFunc(all, func(lhs, rhs keyDistance) int {
+		return cmp.Compare(lhs.distance, rhs.distance)
+	})
+	var expected []string
+	for _, entry := range all[:100] {
+		expected = append(expected, entry.key)
+	}
+	assert.Equal(t, expected, keys)
+
+	// Both indexes run out of values before k is reached.
+	count := 0
+	Interleave(context.Background(), searchLat, searchLong, shops, events, 5_000,
+		func(*Value[int], float64) { count++ },
+		func(*Value[string], float64) { count++ },
+	)
+	assert.Equal(t, 2_000, count)
+}
+
+func Test_KNN_SearchWithSiblingCount(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	// A dense cluster and a few isolated values.
+	for i := range 1_000 {
+		index.AddValue(strconv.Itoa(i), i, 51+r.Float64()*0.1, 13+r.Float64()*0.1)
+	}
+	index.AddValue("sydney", 1, -33.8688, 151.2093)
+
+	siblings := make(map[string]int)
+	index.SearchWithSiblingCount(context.Background(), 51.05, 13.05, func(value *Value[int], count int) bool {
+		siblings[value.Key()] = count
+		node := index.lookup[value.Key()]
+		assert.Equal(t, len(node.parent.children)-1, count)
+		return false
+	})
+	assert.Len(t, siblings, 1_001)
+	// The cluster is split into many leaves, while Sydney is the only value on its face.
+	assert.Greater(t, siblings["0"], 0)
+	assert.Equal(t, 1, siblings["sydney"])
+}
+
+func Test_KNN_WithValueSlabs(t *testing.T) {
+	items := randomItems(10_000)
+	slabs, err := NewKNN[int](14, WithValueSlabs[int](), WithMaxTreeDepth[int](4))
+	assert.NoError(t, err)
+	pointers, err := NewKNN[int](14, WithMaxTreeDepth[int](4))
+	assert.NoError(t, err)
+	for _, item := range items {
+		slabs.AddValue(item.ID, item.Value, item.Lat, item.Long)
+		pointers.AddValue(item.ID, item.Value, item.Lat, item.Long)
+	}
+	// Remove and update some values, which moves values within the slabs.
+	for i := 0; i < len(items); i += 3 {
+		assert.True(t, slabs.RemoveValue(items[i].ID))
+		assert.True(t, pointers.RemoveValue(items[i].ID))
+	}
+	for i := 1; i < len(items); i += 3 {
+		assert.True(t, slabs.UpdatePayload(items[i].ID, -i))
+		assert.True(t, pointers.UpdatePayload(items[i].ID, -i))
+	}
+
+	slabs.indexRoot.WalkNodes(func(node *Node[int]) bool {
+		assert.Len(t, node.slab, len(node.values))
+		for i := range node.values {
+			assert.Same(t, &node.slab[i], node.values[i])
+			assert.Same(t, node, slabs.lookup[node.values[i].Key()])
+		}
+		return true
+	})
+
+	search := func(index *KNN[int]) []Value[int] {
+		var result []Value[int]
+		index.Search(context.Background(), 51.44, 13.55, func(value *Value[int]) bool {
+			// The indexes were filled at different times.
+			copied := *value
+			copied.addedAt = time.Time{}
+			result = append(result, copied)
+			return false
+		})
+		return result
+	}
+	expected := search(pointers)
+	assert.Len(t, expected, 6_666)
+	assert.Equal(t, expected, search(slabs))
+}
+
+func Test_KNN_WithValueSlabs_ConcurrentWrites(t *testing.T) {
+	index, err := NewKNN[int](14, WithValueSlabs[int](), WithMaxTreeDepth[int](4))
+	assert.NoError(t, err)
+	for i := range 200 {
+		index.AddValue(strconv.Itoa(i), i, 48.137, 11.575+float64(i)*0.000_1)
+	}
+	// A value found before a modification of its leaf keeps its content.
+	found := index.KNearest(context.Background(), 48.137, 11.575, 200)
+	assert.True(t, index.RemoveValue("0"))
+	assert.True(t, index.UpdatePayload("1", -1))
+	for _, value := range found {
+		assert.Equal(t, value.Key(), strconv.Itoa(value.Value()))
+	}
+
+	// Writers remove, add and update values of the dense leaf while readers read the found values. Run with -race.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 2_000 {
+			id := strconv.Itoa(i % 200)
+			index.RemoveValue(id)
+			index.AddValue(id, i%200, 48.137, 11.575+float64(i%200)*0.000_1)
+			index.UpdatePayload(id, -(i % 200))
+		}
+	}()
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 200 {
+				for _, value := range index.KNearest(context.Background(), 48.137, 11.575, 20) {
+					payload := value.Value()
+					assert.Equal(t, value.Key(), strconv.Itoa(max(payload, -payload)))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Empty(t, index.CheckConsistency())
+}
+
+func benchmarkSearchDenseLeaves(b *testing.B, opts ...Option[int]) {
+	index, _ := NewKNN[int](14, append(opts, WithMaxTreeDepth[int](6))...)
+	for _, item := range randomItems(500_000) {
+		index.AddValue(item.ID, item.Value, item.Lat, item.Long)
+	}
+	b.ResetTimer()
+	for range b.N {
+		count := 0
+		index.Search(context.Background(), 51.44, 13.55, func(*Value[int]) bool {
+			count++
+			return count >= 100
+		})
+	}
+}
+
+func Benchmark_Search_DenseLeaves(b *testing.B) {
+	benchmarkSearchDenseLeaves(b)
+}
+
+func Benchmark_Search_DenseLeaves_ValueSlabs(b *testing.B) {
+	benchmarkSearchDenseLeaves(b, WithValueSlabs[int]())
+}
+
+func Test_KNN_SearchExpanding(t *testing.T) {
+	index, err := BuildConcurrent(14, randomItems(10_000), 1)
+	assert.NoError(t, err)
+	searchLat, searchLong := 51.44, 13.55
+
+	var expected []*Value[int]
+	index.Search(context.Background(), searchLat, searchLong, func(value *Value[int]) bool {
+		expected = append(expected, value)
+		return len(expected) >= 100
+	})
+	// The radius has to be expanded multiple times.
+	assert.Greater(t, expected[99].DistanceKM(searchLat, searchLong), 8.0)
+	assert.Equal(t, expected, index.SearchExpanding(context.Background(), searchLat, searchLong, 1, 100))
+	// The initial radius is large enough.
+	assert.Equal(t, expected, index.SearchExpanding(context.Background(), searchLat, searchLong, 20_000, 100))
+
+	// The index has less values than requested.
+	assert.Len(t, index.SearchExpanding(context.Background(), searchLat, searchLong, 1, 20_000), 10_000)
+	assert.Len(t, index.SearchExpanding(context.Background(), searchLat, searchLong, 0, 10), 10)
+	assert.Empty(t, index.SearchExpanding(context.Background(), searchLat, searchLong, 1, 0))
+}
+
+func Test_KNN_Fingerprint(t *testing.T) {
+	index, err := BuildConcurrent(14, randomItems(10_000), 1)
+	assert.NoError(t, err)
+
+	before := index.Fingerprint()
+	total := 0
+	for i, entry := range before {
+		total += entry.Count
+		if i > 0 {
+			assert.Less(t, before[i-1].CellID, entry.CellID)
+		}
+	}
+	assert.Equal(t, 10_000, total)
+
+	// Add a value to the leaf of an existing value, which has space left.
+	leaf := index.lookup["0"]
+	assert.Less(t, len(leaf.values), maxValuesPerCell)
+	latLng := index.lookup["0"].FindValue("0").CellID().LatLng()
+	index.AddValue("new", 1, latLng.Lat.Degrees(), latLng.Lng.Degrees())
+
+	after := index.Fingerprint()
+	assert.Len(t, after, len(before))
+	var changed []CellCount
+	for i := range after {
+		assert.Equal(t, before[i].CellID, after[i].CellID)
+		if before[i] != after[i] {
+			changed = append(changed, after[i])
+		}
+	}
+	assert.Equal(t, []CellCount{{CellID: leaf.cellID, Count: len(leaf.values)}}, changed)
+
+	// The values of an index which is not split yet are stored in the root, which has no cell.
+	small, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	small.AddValue("dresden", 1, 51.0504, 13.7373)
+	small.AddValue("berlin", 2, 52.5200, 13.4050)
+	small.AddValue("sydney", 3, -33.8688, 151.2093)
+	assert.True(t, small.indexRoot.IsLeaveNode())
+	dresdenFace := s2.CellIDFromLatLng(s2.LatLngFromDegrees(51.0504, 13.7373)).Face()
+	sydneyFace := s2.CellIDFromLatLng(s2.LatLngFromDegrees(-33.8688, 151.2093)).Face()
+	assert.Less(t, dresdenFace, sydneyFace)
+	assert.Equal(t, []CellCount{
+		{CellID: s2.CellIDFromFace(dresdenFace), Count: 2},
+		{CellID: s2.CellIDFromFace(sydneyFace), Count: 1},
+	}, small.Fingerprint())
+}
+
+func Test_KNN_WithTieBreakByRecency(t *testing.T) {
+	index, err := NewKNN[int](14, WithTieBreakByRecency[int]())
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	for i := range 1_000 {
+		index.AddValue(strconv.Itoa(i), i, RandLat(r), RandLong(r))
+	}
+	// More values than fit into a leaf at the same location, so they are split into the deepest cell.
+	for i := range 20 {
+		index.AddValue("same-"+strconv.Itoa(i), 1_000+i, 48.137, 11.575)
+	}
+
+	var results []int
+	index.Search(context.Background(), 48.137, 11.575, func(value *Value[int]) bool {
+		results = append(results, value.Value())
+		return len(results) >= 20
+	})
+	expected := make([]int, 0, 20)
+	for i := range 20 {
+		expected = append(expected, 1_019-i)
+	}
+	assert.Equal(t, expected, results)
+
+	// The pool applies the tie break, too.
+	pooled := index.NewSearchPool(1).Search(context.Background(), 48.137, 11.575, 20)
+	for i, value := range pooled {
+		assert.Equal(t, expected[i], value.Value())
+	}
+
+	// The order of equal distances is unchanged from the previous values on re-insertion with Transform.
+	index.Transform(func(lat float64, long float64) (float64, float64) { return lat, long })
+	results = results[:0]
+	index.Search(context.Background(), 48.137, 11.575, func(value *Value[int]) bool {
+		results = append(results, value.Value())
+		return len(results) >= 20
+	})
+	assert.Equal(t, expected, results)
+}
+
+func Test_KNN_SearchApproximateBucketed(t *testing.T) {
+	index, err := BuildConcurrent(14, randomItems(10_000), 1)
+	assert.NoError(t, err)
+	searchLat, searchLong := 51.44, 13.55
+	thresholds := []float64{100, 1_000, 5_000}
+	bucketOf := func(km float64) int {
+		bucket, _ := slices.BinarySearch(thresholds, km)
+		return bucket
+	}
+	count := 0
+	previous := 0
+	index.SearchApproximateBucketed(context.Background(), searchLat, searchLong, thresholds, func(value *Value[int], bucket int) bool {
+		count++
+		distance := value.DistanceKM(searchLat, searchLong)
+		assert.GreaterOrEqual(t, bucket, previous)
+		assert.GreaterOrEqual(t, bucketOf(distance), bucket)
+		// The leaf distance differs at most by the diameter of the leaf cell from the exact distance.
+		maxErrorKM := s2.MaxDiagMetric.Value(index.lookup[value.Key()].Level()) * earthRadiusKm
+		assert.LessOrEqual(t, bucketOf(distance-maxErrorKM), bucket)
+		previous = bucket
+		return false
+	})
+	assert.Equal(t, 10_000, count)
+	assert.Equal(t, len(thresholds), previous)
+
+	// The search stops if the callback returns true.
+	count = 0
+	index.SearchApproximateBucketed(context.Background(), searchLat, searchLong, thresholds, func(value *Value[int], bucket int) bool {
+		count++
+		return count == 10
+	})
+	assert.Equal(t, 10, count)
+}
+
+func Test_KNN_TileAggregates(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	// Two clusters of points, each within a small area.
+	clusters := []s2.LatLng{s2.LatLngFromDegrees(48.137, 11.575), s2.LatLngFromDegrees(-33.868, 151.209)}
+	for i := range 100 {
+		center := clusters[i%2]
+		index.AddValue(strconv.Itoa(i), i, center.Lat.Degrees()+r.Float64()*0.001, center.Lng.Degrees()+r.Float64()*0.001)
+	}
+	maxValue := func(values []*Value[int]) int {
+		result := values[0].Value()
+		for _, value := range values[1:] {
+			result = max(result, value.Value())
+		}
+		return result
+	}
+
+	tiles := index.TileAggregates(8, maxValue)
+	assert.Equal(t, map[s2.CellID]TileAgg[int]{
+		s2.CellIDFromLatLng(clusters[0]).Parent(8): {Count: 50, Representative: 98},
+		s2.CellIDFromLatLng(clusters[1]).Parent(8): {Count: 50, Representative: 99},
+	}, tiles)
+
+	// Level 0 groups all values of a face.
+	tiles = index.TileAggregates(0, maxValue)
+	assert.Len(t, tiles, 2)
+
+	empty, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	assert.Empty(t, empty.TileAggregates(8, maxValue))
+	assert.Panics(t, func() { index.TileAggregates(31, maxValue) })
+}
+
+func Test_KNN_CellCorridor(t *testing.T) {
+	index, err := NewKNN[int](12)
+	assert.NoError(t, err)
+	munich, berlin := s2.LatLngFromDegrees(48.137, 11.575), s2.LatLngFromDegrees(52.520, 13.405)
+	index.AddValue("munich", 0, munich.Lat.Degrees(), munich.Lng.Degrees())
+	index.AddValue("berlin", 0, berlin.Lat.Degrees(), berlin.Lng.Degrees())
+	// Points on the great circle between both cities.
+	start, end := s2.PointFromLatLng(munich), s2.PointFromLatLng(berlin)
+	for i := range 50 {
+		point := s2.LatLngFromPoint(s2.Interpolate(float64(i)/50, start, end))
+		index.AddValue(strconv.Itoa(i), i, point.Lat.Degrees(), point.Lng.Degrees())
+	}
+	// A point far away from the great circle.
+	index.AddValue("prague", 0, 50.075, 14.437)
+
+	corridor := index.CellCorridor("munich", "berlin", 1)
+	assert.Equal(t, s2.CellIDFromLatLng(munich).Parent(12), corridor[0])
+	assert.Equal(t, s2.CellIDFromLatLng(berlin).Parent(12), corridor[len(corridor)-1])
+	assert.NotContains(t, corridor, s2.CellIDFromLatLng(s2.LatLngFromDegrees(50.075, 14.437)).Parent(12))
+	// Every point on the great circle is in the corridor, the cells proceed from munich to berlin.
+	assert.Len(t, corridor, 51)
+	for i := 1; i < len(corridor); i++ {
+		assert.Less(t, start.Distance(corridor[i-1].Point()), start.Distance(corridor[i].Point()))
+	}
+	// The reverse corridor contains the same cells.
+	reverse := index.CellCorridor("berlin", "munich", 1)
+	slices.Reverse(reverse)
+	assert.Equal(t, corridor, reverse)
+
+	assert.Nil(t, index.CellCorridor("munich", "unknown", 1))
+	assert.Nil(t, index.CellCorridor("unknown", "berlin", 1))
+}
+
+func Test_KNN_ValuesAt(t *testing.T) {
+	index, err := BuildConcurrent(20, randomItems(10_000), 1)
+	assert.NoError(t, err)
+	for i := range 20 {
+		index.AddValue("colocated-"+strconv.Itoa(i), i, 48.137, 11.575)
+	}
+	// About 11 meters north of the colocated values.
+	index.AddValue("nearby", 100, 48.1371, 11.575)
+
+	keys := func(values []*Value[int]) []string {
+		result := make([]string, 0, len(values))
+		for _, value := range values {
+			result = append(result, value.Key())
+		}
+		slices.Sort(result)
+		return result
+	}
+	expected := make([]string, 0, 20)
+	for i := range 20 {
+		expected = append(expected, "colocated-"+strconv.Itoa(i))
+	}
+	slices.Sort(expected)
+	assert.Equal(t, expected, keys(index.ValuesAt(48.137, 11.575, 1)))
+	assert.Equal(t, append(expected, "nearby"), keys(index.ValuesAt(48.137, 11.575, 20)))
+	assert.Equal(t, []string{"nearby"}, keys(index.ValuesAt(48.1371, 11.575, 0.01)))
+	assert.Empty(t, index.ValuesAt(-48.137, -11.575, 1))
+}
+
+func Test_KNN_NodeCount(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, index.NodeCount())
+	assert.Equal(t, IndexStats{Values: 0, Nodes: 1}, index.Stats())
+
+	r := rand.New(rand.NewSource(1))
+	for i := range 10_000 {
+		index.AddValue(strconv.Itoa(i), i, RandLat(r), RandLong(r))
+	}
+	nodes := index.NodeCount()
+	// Every leaf holds at most maxValuesPerCell values, so there are more nodes than values per leaf.
+	assert.Greater(t, nodes, 10_000/maxValuesPerCell)
+	stats := index.Stats()
+	assert.Equal(t, 10_000, stats.Values)
+	assert.Equal(t, nodes, stats.Nodes)
+	leaves := index.indexRoot.ValuesCount()
+	assert.Equal(t, len(leaves), stats.Leaves)
+	assert.Equal(t, slices.Max(leaves), stats.MaxValuesPerLeaf)
+	assert.LessOrEqual(t, stats.MaxValuesPerLeaf, maxValuesPerCell)
+	assert.InDelta(t, 10_000/float64(len(leaves)), stats.AvgValuesPerLeaf, 1e-9)
+	assert.Equal(t, "10 values in 4 leaves (max 4, avg 2.5 per leaf), 7 nodes",
+		IndexStats{Values: 10, Nodes: 7, Leaves: 4, MaxValuesPerLeaf: 4, AvgValuesPerLeaf: 2.5}.String())
+
+	// Removing the values removes their nodes as well.
+	for i := range 10_000 {
+		index.RemoveValue(strconv.Itoa(i))
+	}
+	assert.Equal(t, 1, index.NodeCount())
+	assert.Equal(t, IndexStats{Nodes: 1}, index.Stats())
+}
+
+func Test_KNN_NearestRelative(t *testing.T) {
+	index, err := NewKNN[int](20)
+	assert.NoError(t, err)
+	// Points north, east, south and west of the origin at increasing distances.
+	index.AddValue("north", 0, 48.01, 11)
+	index.AddValue("east", 1, 48, 11.03)
+	index.AddValue("south", 2, 47.97, 11)
+	index.AddValue("west", 3, 48, 10.94)
+
+	results := index.NearestRelative(context.Background(), 48, 11, 90, 4)
+	assert.Len(t, results, 4)
+	expected := map[string]float64{"east": 0, "south": 90, "west": 180, "north": 270}
+	for i, result := range results {
+		// The difference is compared on the circle, because a bearing of 359.99 is close to 0.
+		assert.Less(t, math.Abs(math.Remainder(result.BearingDeg-expected[result.Value.Key()], 360)), 0.1, result.Value.Key())
+		assert.InDelta(t, result.Value.DistanceKM(48, 11), result.DistanceKM, 0.000_001)
+		if i > 0 {
+			assert.Greater(t, result.DistanceKM, results[i-1].DistanceKM)
+		}
+	}
+	assert.Equal(t, "north", results[0].Value.Key())
+
+	// A point directly ahead has the relative bearing 0 for every heading.
+	for _, heading := range []float64{0, 45, 200, 359} {
+		// The destination 10 km from the origin along the heading.
+		lat1, long1, theta, delta := 48*math.Pi/180, 11*math.Pi/180, heading*math.Pi/180, 10/earthRadiusKm
+		lat2 := math.Asin(math.Sin(lat1)*math.Cos(delta) + math.Cos(lat1)*math.Sin(delta)*math.Cos(theta))
+		long2 := long1 + math.Atan2(math.Sin(theta)*math.Sin(delta)*math.Cos(lat1), math.Cos(delta)-math.Sin(lat1)*math.Sin(lat2))
+		ahead := s2.LatLng{Lat: s1.Angle(lat2), Lng: s1.Angle(long2)}
+		aheadIndex, err := NewKNN[int](30)
+		assert.NoError(t, err)
+		aheadIndex.AddValue("ahead", 0, ahead.Lat.Degrees(), ahead.Lng.Degrees())
+		results = aheadIndex.NearestRelative(context.Background(), 48, 11, heading, 1)
+		assert.Less(t, math.Abs(math.Remainder(results[0].BearingDeg, 360)), 0.000_1, "heading: %v", heading)
+	}
+}
+
+func Test_KNN_NearestJSON(t *testing.T) {
+	type place struct {
+		Name string `json:"name"`
+	}
+	index, err := NewKNN[place](30)
+	assert.NoError(t, err)
+	index.AddValue("berlin", place{Name: "Berlin"}, 52.52, 13.405)
+	index.AddValue("potsdam", place{Name: "Potsdam"}, 52.39, 13.065)
+	index.AddValue("munich", place{Name: "Munich"}, 48.137, 11.575)
+
+	data, err := index.NearestJSON(context.Background(), 52.52, 13.405, 2)
+	assert.NoError(t, err)
+	var results []struct {
+		ID         string  `json:"id"`
+		Lat        float64 `json:"lat"`
+		Long       float64 `json:"long"`
+		DistanceKM float64 `json:"distanceKm"`
+		Value      place   `json:"value"`
+	}
+	assert.NoError(t, json.Unmarshal(data, &results))
+	assert.Len(t, results, 2)
+	assert.Equal(t, "berlin", results[0].ID)
+	assert.InDelta(t, 52.52, results[0].Lat, 1e-6)
+	assert.InDelta(t, 13.405, results[0].Long, 1e-6)
+	assert.InDelta(t, 0, results[0].DistanceKM, 1e-3)
+	assert.Equal(t, place{Name: "Berlin"}, results[0].Value)
+	assert.Equal(t, "potsdam", results[1].ID)
+	assert.InDelta(t, DistanceKM(52.52, 13.405, 52.39, 13.065), results[1].DistanceKM, 1e-3)
+	assert.Equal(t, place{Name: "Potsdam"}, results[1].Value)
+
+	// No results are encoded as empty array.
+	data, err = index.NearestJSON(context.Background(), 52.52, 13.405, 0)
+	assert.NoError(t, err)
+	assert.JSONEq(t, "[]", string(data))
+
+	// Payloads which can't be encoded result in an error.
+	invalid, err := NewKNN[float64](14)
+	assert.NoError(t, err)
+	invalid.AddValue("nan", math.NaN(), 1, 1)
+	_, err = invalid.NearestJSON(context.Background(), 1, 1, 1)
+	assert.ErrorContains(t, err, "marshal value nan")
+}
+
+func Test_KNN_DensityGrid(t *testing.T) {
+	index, err := BuildConcurrent(20, randomItems(1_000), 1)
+	assert.NoError(t, err)
+	// A grid of 2 x 3 cells of 1 x 1 degrees, without any random values inside.
+	bounds := Rect{MinLat: 10, MinLong: -120, MaxLat: 12, MaxLong: -117}
+	for _, value := range index.ValuesAt(11, -118.5, 200_000) {
+		index.RemoveValue(value.Key())
+	}
+	add := func(id string, lat, long float64) {
+		index.AddValue(id, 0, lat, long)
+	}
+	add("north-west", 11.5, -119.5)
+	add("north-west-2", 11.9, -119.9)
+	add("north-east", 11.5, -117.5)
+	add("south-middle", 10.5, -118.5)
+	add("south-east", 10.1, -117.1)
+	add("south-east-2", 10.2, -117.2)
+	add("south-east-3", 10.3, -117.3)
+	add("outside", 12.5, -118.5)
+
+	assert.Equal(t, [][]int{
+		{2, 0, 1},
+		{0, 1, 3},
+	}, index.DensityGrid(bounds, 2, 3))
+	assert.Equal(t, [][]int{{7}}, index.DensityGrid(bounds, 1, 1))
+
+	assert.Nil(t, index.DensityGrid(bounds, 0, 3))
+	assert.Nil(t, index.DensityGrid(Rect{MinLat: 10, MinLong: 10, MaxLat: 10, MaxLong: 11}, 1, 1))
+}
+
+func Test_KNN_CentroidOfNearest(t *testing.T) {
+	index, err := NewKNN[int](20)
+	assert.NoError(t, err)
+	// Points on both sides of the antimeridian, averaging their longitudes would result in 0.
+	index.AddValue("west", 0, 10, 179)
+	index.AddValue("east", 1, 10, -179)
+	index.AddValue("north", 2, 11, 180)
+	index.AddValue("south", 3, 9, 180)
+	index.AddValue("far", 4, -50, 0)
+
+	centroid, ok := index.CentroidOfNearest(context.Background(), 10, 180, 4)
+	assert.True(t, ok)
+	assert.InDelta(t, 10, centroid.Lat.Degrees(), 0.01)
+	assert.InDelta(t, 180, math.Abs(centroid.Lng.Degrees()), 0.000_1)
+
+	// A single result is its own centroid.
+	centroid, ok = index.CentroidOfNearest(context.Background(), 10, 179, 1)
+	assert.True(t, ok)
+	assert.Less(t, DistanceKM(10, 179, centroid.Lat.Degrees(), centroid.Lng.Degrees()), 0.000_1)
+
+	_, ok = index.CentroidOfNearest(context.Background(), 10, 180, 0)
+	assert.False(t, ok)
+	empty, err := NewKNN[int](20)
+	assert.NoError(t, err)
+	_, ok = empty.CentroidOfNearest(context.Background(), 10, 180, 4)
+	assert.False(t, ok)
+}
+
+func Test_KNN_SearchWatermark(t *testing.T) {
+	index, err := BuildConcurrent(14, randomItems(10_000), 1)
+	assert.NoError(t, err)
+	searchLat, searchLong := 51.44, 13.55
+
+	var emitted []*Value[int]
+	watermark := 0.0
+	index.SearchWatermark(context.Background(), searchLat, searchLong, func(value *Value[int], watermarkKM float64) bool {
+		assert.GreaterOrEqual(t, watermarkKM, watermark)
+		// No value below the previous watermark is emitted after it advanced.
+		assert.GreaterOrEqual(t, value.DistanceKM(searchLat, searchLong)+0.000_01, watermark)
+		assert.InDelta(t, value.DistanceKM(searchLat, searchLong), watermarkKM, 0.000_01)
+		watermark = watermarkKM
+		emitted = append(emitted, value)
+		return len(emitted) >= 1_000
+	})
+	assert.Len(t, emitted, 1_000)
+	// All values below the final watermark have been emitted.
+	for _, value := range index.Query(context.Background(), searchLat, searchLong, WithRadiusKM[int](watermark)) {
+		assert.Contains(t, emitted, value)
+	}
+}
+
+func Test_KNN_SkewCoefficient(t *testing.T) {
+	uniform, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	assert.Zero(t, uniform.SkewCoefficient(2))
+	// Random points uniformly distributed on the sphere.
+	r := rand.New(rand.NewSource(1))
+	for i := range 100_000 {
+		point := s2.LatLngFromPoint(s2.PointFromCoords(r.NormFloat64(), r.NormFloat64(), r.NormFloat64()))
+		uniform.AddValue(strconv.Itoa(i), i, point.Lat.Degrees(), point.Lng.Degrees())
+	}
+
+	cluster, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	for i := range 1_000 {
+		cluster.AddValue(strconv.Itoa(i), i, 48.137+r.Float64()*0.01, 11.575+r.Float64()*0.01)
+	}
+
+	for _, level := range []int{0, 2, 4} {
+		assert.Less(t, uniform.SkewCoefficient(level), 0.2, "level: %d", level)
+		assert.Greater(t, uniform.SkewCoefficient(level), 0.0, "level: %d", level)
+	}
+	// Every level has more than a single cell, so a single cluster is highly concentrated.
+	assert.InDelta(t, 5.0/6, cluster.SkewCoefficient(0), 0.000_001)
+	assert.Greater(t, cluster.SkewCoefficient(4), 0.99)
+	assert.Panics(t, func() { cluster.SkewCoefficient(-1) })
+}
+
+func Test_KNN_CoverageGaps(t *testing.T) {
+	index, err := BuildConcurrent(14, randomItems(10_000), 1)
+	assert.NoError(t, err)
+	center := s2.LatLngFromDegrees(48.137, 11.575)
+	region := s2.CapFromCenterAngle(s2.PointFromLatLng(center), s1.Angle(20/earthRadiusKm))
+	covering := (&s2.RegionCoverer{MinLevel: 10, MaxLevel: 10, MaxCells: math.MaxInt}).Covering(region)
+	assert.Greater(t, len(covering), 10)
+
+	// Remove the random values in the region, so only the added values occupy cells.
+	for _, value := range index.ValuesAt(center.Lat.Degrees(), center.Lng.Degrees(), 50_000) {
+		index.RemoveValue(value.Key())
+	}
+	assert.Equal(t, []s2.CellID(covering), index.CoverageGaps(region, 10))
+
+	// Occupy some cells of the covering, one of them with many values, so its node is split.
+	occupied := []s2.CellID{covering[0], covering[len(covering)/2], covering[len(covering)-1]}
+	for i, cellID := range occupied {
+		for j := range 1 + i*20 {
+			child := cellID.ChildBeginAtLevel(20).Advance(int64(j * 1_000))
+			latLng := child.LatLng()
+			index.AddValue("occupied-"+strconv.Itoa(i)+"-"+strconv.Itoa(j), 0, latLng.Lat.Degrees(), latLng.Lng.Degrees())
+		}
+	}
+	gaps := index.CoverageGaps(region, 10)
+	assert.Len(t, gaps, len(covering)-len(occupied))
+	for _, cellID := range occupied {
+		assert.NotContains(t, gaps, cellID)
+	}
+	assert.Panics(t, func() { index.CoverageGaps(region, 31) })
+}
+
+func Test_KNN_WithPayloadInterning(t *testing.T) {
+	index, err := NewKNN[string](14, WithPayloadInterning[string]())
+	assert.NoError(t, err)
+	// Build equal payloads in separate allocations.
+	first := strings.Repeat("payload", 2)
+	second := strings.Repeat("payload", 2)
+	assert.NotSame(t, unsafe.StringData(first), unsafe.StringData(second))
+
+	index.AddValue("1", first, 1, 1)
+	index.AddValue("2", second, 2, 2)
+	index.UpsertValue("3", strings.Repeat("payload", 2), 3, 3)
+	assert.Same(t, unsafe.StringData(first), unsafe.StringData(index.findValue("2").Value()))
+	assert.Same(t, unsafe.StringData(first), unsafe.StringData(index.findValue("3").Value()))
+
+	assert.True(t, index.UpdatePayload("1", strings.Repeat("other", 2)))
+	assert.True(t, index.UpdatePayload("2", strings.Repeat("other", 2)))
+	assert.Same(t, unsafe.StringData(index.findValue("1").Value()), unsafe.StringData(index.findValue("2").Value()))
+
+	// Without interning the payloads are kept separately.
+	plain, err := NewKNN[string](14)
+	assert.NoError(t, err)
+	plain.AddValue("1", first, 1, 1)
+	plain.AddValue("2", second, 2, 2)
+	assert.NotSame(t, unsafe.StringData(plain.findValue("1").Value()), unsafe.StringData(plain.findValue("2").Value()))
+}
+
+func benchmarkPayloadMemory(b *testing.B, opts ...Option[string]) {
+	items := randomItems(100_000)
+	b.ReportAllocs()
+	for range b.N {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		index, _ := NewKNN[string](14, opts...)
+		for _, item := range items {
+			// Few distinct payloads, each value builds its own copy.
+			index.AddValue(item.ID, strings.Repeat("category-", 8)+strconv.Itoa(item.Value%10), item.Lat, item.Long)
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/float64(len(items)), "heap-bytes/value")
+		runtime.KeepAlive(index)
+	}
+}
+
+func Benchmark_PayloadMemory(b *testing.B) {
+	benchmarkPayloadMemory(b)
+}
+
+func Benchmark_PayloadMemory_Interning(b *testing.B) {
+	benchmarkPayloadMemory(b, WithPayloadInterning[string]())
+}
+
+func Test_KNN_WithSecondarySort(t *testing.T) {
+	type entity struct {
+		name     string
+		priority int
+	}
+	priority := func(e entity) int { return e.priority }
+	index, err := NewKNN[entity](14, WithTieBreakByRecency[entity](), WithSecondarySort(priority))
+	assert.NoError(t, err)
+	// Equidistant values at the same location which only differ in their priority.
+	for i, p := range []int{5, 1, 3, 1, 4} {
+		index.AddValue(strconv.Itoa(i), entity{name: strconv.Itoa(i), priority: p}, 48.137, 11.575)
+	}
+	index.AddValue("far", entity{name: "far", priority: 0}, 48.2, 11.6)
+
+	// Equal priorities are ordered by recency.
+	expected := []string{"3", "1", "2", "4", "0", "far"}
+	names := func(values []*Value[entity]) []string {
+		result := make([]string, 0, len(values))
+		for _, value := range values {
+			result = append(result, value.Value().name)
+		}
+		return result
+	}
+	assert.Equal(t, expected, names(index.Query(context.Background(), 48.137, 11.575)))
+	assert.Equal(t, expected[:3], names(index.KNearestWithin(context.Background(), 48.137, 11.575, 3, 10)))
+	assert.Equal(t, expected, names(index.NewSearchPool(1).Search(context.Background(), 48.137, 11.575, 10)))
+
+	// The federated search orders equal distances of different shards.
+	shards := index.Shard(3)
+	assert.Equal(t, expected, names(SearchFederated(context.Background(), shards, 48.137, 11.575, 10)))
+	assert.Empty(t, SearchFederated[entity](context.Background(), nil, 48.137, 11.575, 10))
+}
+
+func Test_KNN_NeedsRebalance(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	needed, reason := index.NeedsRebalance()
+	assert.False(t, needed)
+	assert.Equal(t, "the index is empty", reason)
+
+	r := rand.New(rand.NewSource(1))
+	for i := range 10_000 {
+		index.AddValue(strconv.Itoa(i), i, RandLat(r), RandLong(r))
+	}
+	needed, reason = index.NeedsRebalance()
+	assert.False(t, needed, reason)
+	assert.Contains(t, reason, "values on average")
+
+	// Removing values removes their empty nodes.
+	for i := range 9_000 {
+		index.RemoveValue(strconv.Itoa(i))
+	}
+	needed, reason = index.NeedsRebalance()
+	assert.False(t, needed, reason)
+
+	// Empty nodes created otherwise need pruning.
+	sparse, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	sparse.AddValue("1", 1, 48, 11)
+	emptyCell := s2.CellIDFromLatLng(s2.LatLngFromDegrees(-48, -11)).Parent(10)
+	node := sparse.indexRoot
+	for level := range 11 {
+		node = node.GetOrCreateChild(emptyCell.Parent(level))
+	}
+	needed, reason = sparse.NeedsRebalance()
+	assert.True(t, needed)
+	assert.Contains(t, reason, "of nodes are empty")
+	sparse.Prune()
+	needed, reason = sparse.NeedsRebalance()
+	assert.False(t, needed, reason)
+
+	// A shallow tree with clustered values can't split the leaves.
+	shallow, err := NewKNN[int](4)
+	assert.NoError(t, err)
+	for i := range 1_000 {
+		shallow.AddValue(strconv.Itoa(i), i, 48+r.Float64(), 11+r.Float64())
+	}
+	needed, reason = shallow.NeedsRebalance()
+	assert.True(t, needed)
+	assert.Equal(t, "100% of leaves exceed capacity of 8 values due to max-depth overflow at depth 4", reason)
+}
+
+func Test_KNN_SwapValue(t *testing.T) {
+	for _, opts := range [][]Option[int]{nil, {WithValueSlabs[int]()}} {
+		index, err := NewKNN[int](14, opts...)
+		assert.NoError(t, err)
+		r := rand.New(rand.NewSource(1))
+		for i := range 100 {
+			index.AddValue(strconv.Itoa(i), i, RandLat(r), RandLong(r))
+		}
+
+		old, existed := index.SwapValue("new", 1, 48.137, 11.575)
+		assert.False(t, existed)
+		assert.Nil(t, old)
+		assert.Equal(t, 1, index.findValue("new").Value())
+
+		before := *index.findValue("new")
+		old, existed = index.SwapValue("new", 2, 52.52, 13.405)
+		assert.True(t, existed)
+		assert.Equal(t, before.key, old.Key())
+		assert.Equal(t, 1, old.Value())
+		assert.Equal(t, s2.CellIDFromLatLng(s2.LatLngFromDegrees(48.137, 11.575)), old.CellID())
+		assert.Equal(t, before.AddedAt(), old.AddedAt())
+
+		// The index reflects the new state.
+		current := index.findValue("new")
+		assert.Equal(t, 2, current.Value())
+		assert.Equal(t, s2.CellIDFromLatLng(s2.LatLngFromDegrees(52.52, 13.405)), current.CellID())
+		assert.Equal(t, 101, index.Count())
+		assert.Empty(t, index.ValuesAt(48.137, 11.575, 1))
+		assert.Equal(t, []*Value[int]{current}, index.ValuesAt(52.52, 13.405, 1))
+
+		// Swapping more values than fit in a slab keeps the returned copies intact.
+		for i := range 100 {
+			old, existed = index.SwapValue(strconv.Itoa(i), -i, 48.137, 11.575)
+			assert.True(t, existed)
+			assert.Equal(t, i, old.Value())
+		}
+		assert.Panics(t, func() { index.SwapValue("new", 3, 91, 0) })
+	}
+}
+
+func Test_KNN_PopValue(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	for i := range 1_000 {
+		index.AddValue(strconv.Itoa(i), i, RandLat(r), RandLong(r))
+	}
+
+	value, ok := index.PopValue("1")
+	assert.True(t, ok)
+	assert.Equal(t, 1, value)
+	assert.False(t, index.HasValue("1"))
+	value, ok = index.PopValue("1")
+	assert.False(t, ok)
+	assert.Zero(t, value)
+
+	// Concurrent pops return every value exactly once.
+	var wg sync.WaitGroup
+	popped := make([][]int, 4)
+	for worker := range popped {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 1_000 {
+				if value, ok := index.PopValue(strconv.Itoa(i)); ok {
+					popped[worker] = append(popped[worker], value)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	all := slices.Concat(popped...)
+	slices.Sort(all)
+	assert.Len(t, all, 999)
+	assert.Equal(t, 0, all[0])
+	assert.Equal(t, 2, all[1])
+	assert.Zero(t, index.Count())
+}
+
+func Test_KNN_RadiusPage(t *testing.T) {
+	index, err := BuildConcurrent(14, randomItems(10_000), 1)
+	assert.NoError(t, err)
+	searchLat, searchLong := 51.44, 13.55
+	// Colocated values have equal distances, which are split across pages.
+	for i := range 20 {
+		index.AddValue("colocated-"+strconv.Itoa(i), i, 51.5, 13.6)
+	}
+	expected := index.Query(context.Background(), searchLat, searchLong, WithRadiusKM[int](2_000))
+	assert.Greater(t, len(expected), 100)
+
+	var all []*Value[int]
+	seen := make(map[string]bool)
+	cursor := Cursor{}
+	for {
+		page, next, more := index.RadiusPage(context.Background(), searchLat, searchLong, 2_000, cursor, 7)
+		assert.LessOrEqual(t, len(page), 7)
+		for _, value := range page {
+			assert.False(t, seen[value.Key()], value.Key())
+			seen[value.Key()] = true
+		}
+		all = append(all, page...)
+		cursor = next
+		if !more {
+			break
+		}
+		assert.Len(t, page, 7)
+	}
+	assert.ElementsMatch(t, expected, all)
+	for i := 1; i < len(all); i++ {
+		assert.LessOrEqual(t, all[i-1].DistanceKM(searchLat, searchLong), all[i].DistanceKM(searchLat, searchLong)+0.000_01)
+	}
+
+	// The last cursor has no more values.
+	page, next, more := index.RadiusPage(context.Background(), searchLat, searchLong, 2_000, cursor, 7)
+	assert.Empty(t, page)
+	assert.Equal(t, cursor, next)
+	assert.False(t, more)
+}
+
+func Test_KNN_SearchBanded(t *testing.T) {
+	index, err := BuildConcurrent(14, randomItems(10_000), 1)
+	assert.NoError(t, err)
+	searchLat, searchLong := 51.44, 13.55
+	bands := []float64{200, 500, 1_000}
+	all := index.Query(context.Background(), searchLat, searchLong, WithRadiusKM[int](1_000))
+
+	for _, perBand := range []int{1, 3, 1_000} {
+		expected := make(map[int][]*Value[int])
+		for _, value := range all {
+			band, _ := slices.BinarySearch(bands, value.DistanceKM(searchLat, searchLong))
+			if len(expected[band]) < perBand {
+				expected[band] = append(expected[band], value)
+			}
+		}
+		assert.Equal(t, expected, index.SearchBanded(context.Background(), searchLat, searchLong, bands, perBand), "per band: %d", perBand)
+	}
+	// The inner band is empty.
+	banded := index.SearchBanded(context.Background(), searchLat, searchLong, []float64{0.001, 1_000}, 2)
+	assert.NotContains(t, banded, 0)
+	assert.Len(t, banded[1], 2)
+
+	assert.Empty(t, index.SearchBanded(context.Background(), searchLat, searchLong, nil, 2))
+	assert.Empty(t, index.SearchBanded(context.Background(), searchLat, searchLong, bands, 0))
+}
+
+func Test_KNN_NearestPerSector(t *testing.T) {
+	index, err := NewKNN[int](20)
+	assert.NoError(t, err)
+	// One point in each quadrant and further points behind them.
+	index.AddValue("north-east", 0, 48.1, 11.1)
+	index.AddValue("south-east", 1, 47.9, 11.1)
+	index.AddValue("south-west", 2, 47.9, 10.9)
+	index.AddValue("north-west", 3, 48.1, 10.9)
+	index.AddValue("north-east-far", 4, 48.5, 11.5)
+	index.AddValue("south-west-far", 5, 47.5, 10.5)
+
+	keys := func(values []*Value[int]) []string {
+		result := make([]string, 0, len(values))
+		for _, value := range values {
+			if value == nil {
+				result = append(result, "")
+				continue
+			}
+			result = append(result, value.Key())
+		}
+		return result
+	}
+	assert.Equal(t, []string{"north-east", "south-east", "south-west", "north-west"}, keys(index.NearestPerSector(context.Background(), 48, 11, 4)))
+	// With eight sectors the points are in every other sector.
+	assert.Equal(t, []string{"north-east", "", "", "south-east", "south-west", "", "", "north-west"}, keys(index.NearestPerSector(context.Background(), 48, 11, 8)))
+
+	index.RemoveValue("south-east")
+	assert.Equal(t, []string{"north-east", "", "south-west", "north-west"}, keys(index.NearestPerSector(context.Background(), 48, 11, 4)))
+	assert.Nil(t, index.NearestPerSector(context.Background(), 48, 11, 0))
+}
+
+func Test_KNN_SearchClusteredAtLevel(t *testing.T) {
+	items := randomItems(10_000)
+	index, err := BuildConcurrent(14, items, 2)
+	assert.NoError(t, err)
+
+	const level = 4
+	searchLat, searchLong := 48.137, 11.575
+	// The expected result is the nearest value of every cell at the level, ordered by distance.
+	all := slices.Clone(items)
+	slices.SortFunc(all, func(lhs, rhs Item[int]) int {
+		return cmp.Compare(DistanceKM(searchLat, searchLong, lhs.Lat, lhs.Long), DistanceKM(searchLat, searchLong, rhs.Lat, rhs.Long))
+	})
+	var expected []string
+	seen := make(map[s2.CellID]bool)
+	for _, item := range all {
+		parent := s2.CellIDFromLatLng(s2.LatLngFromDegrees(item.Lat, item.Long)).Parent(level)
+		if !seen[parent] {
+			seen[parent] = true
+			expected = append(expected, item.ID)
+		}
+	}
+
+	for _, k := range []int{0, 1, 20, len(expected) + 1} {
+		clustered := index.SearchClusteredAtLevel(context.Background(), searchLat, searchLong, level, k)
+		actual := make([]string, len(clustered))
+		for i, value := range clustered {
+			actual[i] = value.Key()
+		}
+		assert.Equal(t, expected[:min(k, len(expected))], actual, "k: %d", k)
+	}
+
+	assert.Panics(t, func() { index.SearchClusteredAtLevel(context.Background(), searchLat, searchLong, 31, 1) })
+}
+
+func Test_KNN_MeasureRecall(t *testing.T) {
+	items := randomItems(10_000)
+	recall := make(map[int]float64)
+	for _, precision := range []int{1, MaxPrecision} {
+		index, err := BuildConcurrent(precision, items, 2)
+		assert.NoError(t, err)
+		recall[precision] = index.MeasureRecall(10, 50, rand.New(rand.NewSource(1)))
+	}
+	// The smaller leaves of a higher precision improve the recall. The values of a leaf are returned at the
+	// distance of the leaf, so even at the max precision some of the nearest values are missed.
+	assert.Less(t, recall[1], 0.5)
+	assert.Greater(t, recall[MaxPrecision], recall[1])
+	assert.Less(t, recall[MaxPrecision], 1.0)
+	// The recall is the recall of an approximate query.
+	index, err := BuildConcurrent(14, items, 2)
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	lat, long := -90+r.Float64()*180, -180+r.Float64()*360
+	exact := index.Query(context.Background(), lat, long, WithK[int](10))
+	approximate := index.Query(context.Background(), lat, long, WithK[int](10), WithExact[int](false))
+	hits := 0
+	for _, value := range exact {
+		if slices.Contains(approximate, value) {
+			hits++
+		}
+	}
+	assert.Equal(t, float64(hits)/10, index.MeasureRecall(10, 1, rand.New(rand.NewSource(1))))
+
+	empty, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, empty.MeasureRecall(10, 10, rand.New(rand.NewSource(1))))
+}
+
+func Test_KNN_CountMatchingWithinRadius(t *testing.T) {
+	items := randomItems(10_000)
+	index, err := BuildConcurrent(14, items, 2)
+	assert.NoError(t, err)
+	even := func(value *Value[int]) bool {
+		return value.Value()%2 == 0
+	}
+
+	searchLat, searchLong := 48.137, 11.575
+	for _, radiusKM := range []float64{0, 500, 2_000, 20_100} {
+		expected := 0
+		for _, item := range items {
+			if item.Value%2 == 0 && DistanceKM(searchLat, searchLong, item.Lat, item.Long) <= radiusKM {
+				expected++
+			}
+		}
+		assert.Equal(t, expected, index.CountMatchingWithinRadius(context.Background(), searchLat, searchLong, radiusKM, even), "radius: %f", radiusKM)
+	}
+}
+
+func Test_KNN_CheckConsistency(t *testing.T) {
+	index, err := BuildConcurrent(14, randomItems(10_000), 2)
+	assert.NoError(t, err)
+	// Splits and removes keep the lookup map consistent.
+	r := rand.New(rand.NewSource(2))
+	for i := range 1_000 {
+		index.UpsertValue(strconv.Itoa(i), i, RandLat(r), RandLong(r))
+		index.RemoveValue(strconv.Itoa(1_000 + i))
+	}
+	assert.Empty(t, index.CheckConsistency())
+
+	// Point the lookup entries to wrong nodes.
+	index.lookup["2000"] = index.indexRoot
+	index.lookup["unknown"] = index.lookup["3000"]
+	index.lookup["4000"].RemoveValue("4000")
+	assert.Equal(t, []string{"2000", "4000", "unknown"}, index.CheckConsistency())
+}
+
+func Test_KNN_DistanceKM_SameNode(t *testing.T) {
+	index, err := NewKNN[int](13)
+	assert.NoError(t, err)
+	// Two points about 100 m apart in the same cell at the precision of the index.
+	index.AddValue("a", 1, 51.0504, 13.7373)
+	index.AddValue("b", 2, 51.0504, 13.7387)
+	assert.Same(t, index.lookup["a"], index.lookup["b"])
+	a, b := index.findValue("a"), index.findValue("b")
+	assert.Equal(t, a.CellID().Parent(13), b.CellID().Parent(13))
+
+	searchLat, searchLong := 51.0604, 13.7373
+	assert.InDelta(t, DistanceKM(searchLat, searchLong, 51.0504, 13.7373), a.DistanceKM(searchLat, searchLong), 1e-5)
+	assert.InDelta(t, DistanceKM(searchLat, searchLong, 51.0504, 13.7387), b.DistanceKM(searchLat, searchLong), 1e-5)
+	assert.NotEqual(t, a.DistanceKM(searchLat, searchLong), b.DistanceKM(searchLat, searchLong))
+}
@@ -0,0 +1,69 @@
+package go_sknn
+
+import (
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+)
+
+// latencyReservoirSize is the number of samples kept to calculate the latency percentiles.
+const latencyReservoirSize = 1024
+
+// LatencyStat contains the latency percentiles of the recorded searches.
+type LatencyStat struct {
+	Count int
+	P50   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+}
+
+// latencyRecorder keeps a uniform sample of search latencies using reservoir sampling.
+type latencyRecorder struct {
+	mutex   sync.Mutex
+	count   int
+	samples []time.Duration
+	random  *rand.Rand
+}
+
+func newLatencyRecorder() *latencyRecorder {
+	return &latencyRecorder{
+		samples: make([]time.Duration, 0, latencyReservoirSize),
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (l *latencyRecorder) record(duration time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.count++
+	if len(l.samples) < latencyReservoirSize {
+		l.samples = append(l.samples, duration)
+		return
+	}
+	// Replace a random sample, so every recorded latency has the same chance to be in the reservoir.
+	if i := l.random.Intn(l.count); i < latencyReservoirSize {
+		l.samples[i] = duration
+	}
+}
+
+func (l *latencyRecorder) stats() LatencyStat {
+	l.mutex.Lock()
+	sorted := slices.Clone(l.samples)
+	count := l.count
+	l.mutex.Unlock()
+
+	if len(sorted) == 0 {
+		return LatencyStat{}
+	}
+	slices.Sort(sorted)
+	percentile := func(p float64) time.Duration {
+		return sorted[int(p*float64(len(sorted)-1))]
+	}
+	return LatencyStat{
+		Count: count,
+		P50:   percentile(0.50),
+		P95:   percentile(0.95),
+		P99:   percentile(0.99),
+	}
+}
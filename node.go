@@ -1,6 +1,7 @@
 package go_sknn
 
 import (
+	"slices"
 	"sync"
 
 	"github.com/golang/geo/s2"
@@ -11,13 +12,26 @@ const (
 )
 
 type Node[T any] struct {
-	cellID        s2.CellID
-	values        []*Value[T]
-	children      []*Node[T]
-	parent        *Node[T]
+	cellID   s2.CellID
+	values   []*Value[T]
+	children []*Node[T]
+	// parent is kept when the node is removed from its parent, because concurrent searches can still hold
+	// the node and read its level.
+	parent *Node[T]
+	// A goroutine holding both locks takes the values lock first, like a split and a search of a leaf do.
 	childMutex    sync.RWMutex
 	valuesMutex   sync.RWMutex
 	maxIndexDepth int
+	// cacheCells enables caching the cell geometry of new nodes in cell.
+	cacheCells bool
+	cell       *s2.Cell
+	// useSlab enables storing the values of the node in slab, a single contiguous slice.
+	// In this mode values[i] always points to slab[i].
+	useSlab bool
+	slab    []Value[T]
+	// spilled is true if the subtree of the node was evicted to a node store. A spilled node has no children
+	// and no values until it is loaded again. It is guarded by both the child and the values lock.
+	spilled bool
 }
 
 func (n *Node[T]) ValuesCount() []int {
@@ -49,6 +63,13 @@ func (n *Node[T]) GetOrCreateChild(childCellID s2.CellID) *Node[T] {
 		}
 	}
 
+	child := n.newChild(childCellID)
+	n.children = append(n.children, child)
+	return child
+}
+
+// newChild creates a child node for the cell without adding it to the children of the node.
+func (n *Node[T]) newChild(childCellID s2.CellID) *Node[T] {
 	child := &Node[T]{
 		cellID:        childCellID,
 		values:        []*Value[T]{},
@@ -57,28 +78,33 @@ func (n *Node[T]) GetOrCreateChild(childCellID s2.CellID) *Node[T] {
 		childMutex:    sync.RWMutex{},
 		valuesMutex:   sync.RWMutex{},
 		maxIndexDepth: n.maxIndexDepth,
+		cacheCells:    n.cacheCells,
+		useSlab:       n.useSlab,
+	}
+	if child.cacheCells {
+		cell := s2.CellFromCellID(childCellID)
+		child.cell = &cell
 	}
-	n.children = append(n.children, child)
 	return child
 }
 
-func (n *Node[T]) AddChildrenToQueue(point s2.Point, addFunction func(*Node[T], float64)) {
-	n.childMutex.RLock()
-	defer n.childMutex.RUnlock()
-	for _, child := range n.children {
-		addFunction(child, float64(s2.CellFromCellID(child.cellID).Distance(point)))
+// Distance returns the distance between the cell of the node and the point as chord angle.
+func (n *Node[T]) Distance(point s2.Point) float64 {
+	if n.cell != nil {
+		return float64(n.cell.Distance(point))
 	}
+	return float64(s2.CellFromCellID(n.cellID).Distance(point))
 }
 
-func (n *Node[T]) AddChildrenToQueueInterface(point s2.Point, addFunction func(interface{}, float64)) {
+func (n *Node[T]) AddChildrenToQueue(point s2.Point, addFunction func(*Node[T], float64)) {
 	n.childMutex.RLock()
 	defer n.childMutex.RUnlock()
 	for _, child := range n.children {
-		addFunction(child, float64(s2.CellFromCellID(child.cellID).Distance(point)))
+		addFunction(child, child.Distance(point))
 	}
 }
 
-func (n *Node[T]) AddValuesToQueue(point s2.Point, addFunction func(interface{}, float64)) {
+func (n *Node[T]) AddValuesToQueue(point s2.Point, addFunction func(*Value[T], float64)) {
 	n.valuesMutex.RLock()
 	defer n.valuesMutex.RUnlock()
 	for _, value := range n.values {
@@ -99,47 +125,112 @@ func (n *Node[T]) FilerValues(callback func(*Value[T]) bool) bool {
 	return false
 }
 
-func (n *Node[T]) AddValue(key string, value T, cell s2.CellID) *Node[T] {
-	valueChildCell := cell.Parent(n.cellID.Level() + 1)
-	n.childMutex.RLock()
-	hasChildren := len(n.children) != 0
-	n.childMutex.RUnlock()
+// AddValue adds a value to the subtree of the node and returns the node the value was added to.
+// If adding the value splits a node, the values of the split node are moved to its children
+// and onMove is called with every moved value and its new node.
+func (n *Node[T]) AddValue(value *Value[T], onMove func(*Value[T], *Node[T])) *Node[T] {
+	valueChildCell := value.cell.Parent(n.Level() + 1)
+	// The values lock is held while checking for children. Children of a leaf are only created by a split,
+	// which holds the values lock, so a concurrent add can't split the node between the check and the add.
+	n.valuesMutex.Lock()
 	// If the node has children, add the value to the child node.
-	if hasChildren {
-		return n.GetOrCreateChild(valueChildCell).AddValue(key, value, cell)
+	if !n.IsLeaveNode() {
+		n.valuesMutex.Unlock()
+		return n.GetOrCreateChild(valueChildCell).AddValue(value, onMove)
 	}
-
-	n.valuesMutex.Lock()
 	defer n.valuesMutex.Unlock()
 
 	// If the values in the node don't exceed the maximum, add the value to the node and return
 	if len(n.values)+1 <= maxValuesPerCell {
-		n.values = append(n.values, &Value[T]{key: key, value: value, cell: cell})
+		n.appendValue(value)
 		return n
 	}
 	// If is already at the max depth, add the value to the node and return,
 	// because we can't split a node which is already at max depth.
-	if n.cellID.Level() >= n.maxIndexDepth {
-		n.values = append(n.values, &Value[T]{key: key, value: value, cell: cell})
+	if n.Level() >= n.maxIndexDepth {
+		n.appendValue(value)
 		return n
 	}
 	// If the node is not at the max depth, split the node.
-	// Iterate over the values and add them to the children of this node they belong to.
+	// The values and the new value are moved to new children, which are not visible to searches yet.
+	var children []*Node[T]
+	childFor := func(childCellID s2.CellID) *Node[T] {
+		for _, child := range children {
+			if child.cellID == childCellID {
+				return child
+			}
+		}
+		child := n.newChild(childCellID)
+		children = append(children, child)
+		return child
+	}
 	for _, v := range n.values {
-		n.GetOrCreateChild(v.cell.Parent(n.cellID.Level()+1)).AddValue(v.key, v.value, cell)
+		node := childFor(v.cell.Parent(n.Level()+1)).AddValue(v, onMove)
+		if onMove != nil {
+			onMove(v, node)
+		}
 	}
-	// Remove all values, because they are all added to the children of this node.
+	node := childFor(valueChildCell).AddValue(value, onMove)
+	// The children are published and the values removed in one step under both locks, so a concurrent search
+	// finds the values either in the node or in its children.
+	n.childMutex.Lock()
+	n.children = children
 	n.values = nil
-	// Add the new value to the child node.
-	return n.GetOrCreateChild(valueChildCell).AddValue(key, value, cell)
+	n.slab = nil
+	n.childMutex.Unlock()
+	return node
 }
 
-func (n *Node[T]) UpdateValue(key string, value T) {
+// UpdateValue replaces the value stored for key in the node.
+// The stored *Value is not modified, because searches may have returned it already. A copy with the new
+// value replaces it instead. It returns false if the node does not contain the key.
+func (n *Node[T]) UpdateValue(key string, value T) bool {
+	n.valuesMutex.Lock()
+	defer n.valuesMutex.Unlock()
 	for index := range n.values {
 		if n.values[index].key == key {
-			n.values[index].value = value
+			if n.useSlab {
+				n.copySlab(cap(n.slab))
+				n.slab[index].value = value
+				return true
+			}
+			updated := *n.values[index]
+			updated.value = value
+			n.values[index] = &updated
+			return true
+		}
+	}
+	return false
+}
+
+// FindValue returns the value stored for key in the node or nil if the node does not contain the key.
+func (n *Node[T]) FindValue(key string) *Value[T] {
+	n.valuesMutex.RLock()
+	defer n.valuesMutex.RUnlock()
+	for _, value := range n.values {
+		if value.key == key {
+			return value
 		}
 	}
+	return nil
+}
+
+// Level returns the S2 level of the cell of the node.
+// The root node covers the whole sphere and has the level -1, so its children are the six face cells.
+func (n *Node[T]) Level() int {
+	if n.parent == nil {
+		return -1
+	}
+	return n.cellID.Level()
+}
+
+// leafCell returns the cell of the node as leaf cell of the value stored in it. The root covers the whole sphere
+// and has no cell, so for a value stored in the root the face cell of the value is returned.
+func (n *Node[T]) leafCell(value *Value[T]) s2.CellID {
+	if n.parent == nil {
+		return s2.CellIDFromFace(value.cell.Face())
+	}
+	return n.cellID
 }
 
 func (n *Node[T]) IsLeaveNode() bool {
@@ -159,22 +250,68 @@ func (n *Node[T]) RemoveValue(key string) {
 		}
 	}
 	if foundIndex != -1 {
-		n.values[foundIndex] = n.values[len(n.values)-1]
-		n.values = n.values[:len(n.values)-1]
+		n.removeValueAt(foundIndex)
 	}
 }
 
-func (n *Node[T]) Prune() {
-	n.valuesMutex.RLock()
-	defer n.valuesMutex.RUnlock()
-	if len(n.values) != 0 {
+// appendValue adds the value to the values of the node. The caller must hold the values lock.
+// In slab mode the value is copied into the slab.
+func (n *Node[T]) appendValue(value *Value[T]) {
+	if !n.useSlab {
+		n.values = append(n.values, value)
 		return
 	}
-	if len(n.children) == 0 {
-		return
+	if len(n.slab) == cap(n.slab) {
+		n.copySlab(max(2*cap(n.slab), maxValuesPerCell))
+	}
+	// The entries beyond the length of the slab were never handed out, so appending doesn't modify a value.
+	n.slab = append(n.slab, *value)
+	n.values = append(n.values, &n.slab[len(n.slab)-1])
+}
+
+// copySlab copies the slab to a new slab with the given capacity and points the values to it. The caller must
+// hold the values lock. The old slab is never written again, because searches may still read its values.
+func (n *Node[T]) copySlab(capacity int) {
+	slab := make([]Value[T], len(n.slab), capacity)
+	copy(slab, n.slab)
+	n.slab = slab
+	for i := range n.values {
+		n.values[i] = &n.slab[i]
+	}
+}
+
+// removeValueAt removes the value at index i by replacing it with the last value. The caller must hold the values lock.
+func (n *Node[T]) removeValueAt(i int) {
+	last := len(n.values) - 1
+	if n.useSlab {
+		// The slab is copied before it is modified, the pointer values[i] then points to slab[i] of the copy.
+		n.copySlab(cap(n.slab))
+		n.slab[i] = n.slab[last]
+		n.slab[last] = Value[T]{}
+		n.slab = n.slab[:last]
+	} else {
+		n.values[i] = n.values[last]
+	}
+	n.values[last] = nil
+	n.values = n.values[:last]
+}
+
+// Prune removes the node from its parent if it has no values and no children, and continues with the parent,
+// so the whole chain of empty ancestors is removed. It stops at the first node which isn't empty and at the root.
+func (n *Node[T]) Prune() {
+	node := n
+	for node.parent != nil && node.isEmptyLeaf() {
+		node.parent.RemoveChild(node.cellID)
+		node = node.parent
 	}
-	n.parent.RemoveChild(n.cellID)
-	n.parent = nil
+}
+
+// isEmptyLeaf returns true if the node has no values and no children and isn't evicted to a node store.
+func (n *Node[T]) isEmptyLeaf() bool {
+	n.valuesMutex.RLock()
+	empty := len(n.values) == 0 && !n.spilled
+	n.valuesMutex.RUnlock()
+	return empty && n.IsLeaveNode()
 }
 
 func (n *Node[T]) RemoveChild(id s2.CellID) {
@@ -183,8 +320,144 @@ func (n *Node[T]) RemoveChild(id s2.CellID) {
 
 	for i, child := range n.children {
 		if child.cellID == id {
-			n.children = append(n.children[:i], n.children[i+1:]...)
+			n.children = slices.Delete(n.children, i, i+1)
 			return
 		}
 	}
 }
+
+// isSpilled returns true if the subtree of the node is evicted to a node store.
+func (n *Node[T]) isSpilled() bool {
+	n.valuesMutex.RLock()
+	defer n.valuesMutex.RUnlock()
+	return n.spilled
+}
+
+// ChildContaining returns the child node whose cell contains the given cell or nil if there is none.
+func (n *Node[T]) ChildContaining(cellID s2.CellID) *Node[T] {
+	n.childMutex.RLock()
+	defer n.childMutex.RUnlock()
+	for _, child := range n.children {
+		if child.cellID.Contains(cellID) {
+			return child
+		}
+	}
+	return nil
+}
+
+// SubtreeCount returns the number of nodes and values in the subtree of the node, including the node itself.
+func (n *Node[T]) SubtreeCount() (nodes int, values int) {
+	n.valuesMutex.RLock()
+	values = len(n.values)
+	children := n.childNodes()
+	n.valuesMutex.RUnlock()
+
+	nodes = 1
+	for _, child := range children {
+		childNodes, childValues := child.SubtreeCount()
+		nodes += childNodes
+		values += childValues
+	}
+	return nodes, values
+}
+
+// CollectValues appends all values of the subtree of the node to result and returns it.
+func (n *Node[T]) CollectValues(result []*Value[T]) []*Value[T] {
+	n.valuesMutex.RLock()
+	result = append(result, n.values...)
+	children := n.childNodes()
+	n.valuesMutex.RUnlock()
+
+	for _, child := range children {
+		result = child.CollectValues(result)
+	}
+	return result
+}
+
+// childNodes returns a copy of the children of the node. If the caller holds the values lock, the values and
+// the children are read consistently, because a split holds the values lock until it moved the values to the children.
+func (n *Node[T]) childNodes() []*Node[T] {
+	n.childMutex.RLock()
+	defer n.childMutex.RUnlock()
+	return slices.Clone(n.children)
+}
+
+// visitLeaf calls fn with every value of the node and returns true if the node is a leaf. It returns false
+// without calling fn if the node has children. The children are checked under the values lock like in childNodes,
+// so the values of a concurrently split node are either visited here or found in its children.
+func (n *Node[T]) visitLeaf(fn func(*Value[T])) bool {
+	n.valuesMutex.RLock()
+	defer n.valuesMutex.RUnlock()
+	if !n.IsLeaveNode() {
+		return false
+	}
+	for _, value := range n.values {
+		fn(value)
+	}
+	return true
+}
+
+// WalkNodes calls fn for the node and its descendants in depth-first order.
+// The children of a node are only visited if fn returns true for the node.
+func (n *Node[T]) WalkNodes(fn func(*Node[T]) bool) {
+	if !fn(n) {
+		return
+	}
+	n.childMutex.RLock()
+	defer n.childMutex.RUnlock()
+	for _, child := range n.children {
+		child.WalkNodes(fn)
+	}
+}
+
+// CountEmpty returns the number of nodes in the subtree of the node which have no values and no
+// descendants with values, and whether the node itself is such a node.
+func (n *Node[T]) CountEmpty() (count int, empty bool) {
+	n.valuesMutex.RLock()
+	// The values of a spilled node are stored in the node store.
+	empty = len(n.values) == 0 && !n.spilled
+	n.valuesMutex.RUnlock()
+
+	n.childMutex.RLock()
+	defer n.childMutex.RUnlock()
+	for _, child := range n.children {
+		childCount, childEmpty := child.CountEmpty()
+		count += childCount
+		empty = empty && childEmpty
+	}
+	if empty {
+		count++
+	}
+	return count, empty
+}
+
+// PruneEmpty removes all descendants of the node which have no values and no descendants with values.
+// It returns true if the node itself is empty after pruning.
+func (n *Node[T]) PruneEmpty() bool {
+	n.childMutex.Lock()
+	children := n.children[:0]
+	for _, child := range n.children {
+		if child.PruneEmpty() {
+			continue
+		}
+		children = append(children, child)
+	}
+	clear(n.children[len(children):])
+	n.children = children
+	hasChildren := len(n.children) != 0
+	n.childMutex.Unlock()
+
+	n.valuesMutex.RLock()
+	defer n.valuesMutex.RUnlock()
+	return len(n.values) == 0 && !hasChildren && !n.spilled
+}
+
+// SiblingCount returns the number of other children of the parent of the node.
+func (n *Node[T]) SiblingCount() int {
+	if n.parent == nil {
+		return 0
+	}
+	n.parent.childMutex.RLock()
+	defer n.parent.childMutex.RUnlock()
+	return len(n.parent.children) - 1
+}
@@ -0,0 +1,75 @@
+package go_sknn
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/golang/geo/s2"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Node_AddValue_Concurrent(t *testing.T) {
+	index, err := NewKNN[int](20)
+	assert.NoError(t, err)
+	root := index.newRoot()
+
+	// All goroutines add to the same hot cell, so the leaves are split while other goroutines add to them.
+	const goroutines, perGoroutine = 8, 500
+	var wg sync.WaitGroup
+	for g := range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perGoroutine {
+				offset := float64(g*perGoroutine+i) * 0.000_001
+				cellID := s2.CellIDFromLatLng(s2.LatLngFromDegrees(48.137+offset, 11.575+offset))
+				root.AddValue(&Value[int]{key: strconv.Itoa(g*perGoroutine + i), cell: cellID}, nil)
+			}
+		}()
+	}
+	wg.Wait()
+
+	values := root.CollectValues(nil)
+	assert.Len(t, values, goroutines*perGoroutine)
+	keys := make(map[string]bool, len(values))
+	for _, value := range values {
+		keys[value.key] = true
+	}
+	assert.Len(t, keys, goroutines*perGoroutine)
+	// Only leaves hold values and every value is stored in a node containing its cell.
+	root.WalkNodes(func(node *Node[int]) bool {
+		if !node.IsLeaveNode() {
+			assert.Empty(t, node.values)
+		}
+		for _, value := range node.values {
+			assert.True(t, node.parent == nil || node.cellID.Contains(value.cell))
+		}
+		return true
+	})
+}
+
+func Test_Node_AddValue_SplitKeepsCells(t *testing.T) {
+	index, err := NewKNN[int](20)
+	assert.NoError(t, err)
+	root := index.newRoot()
+
+	// Nine distinct points close to each other, so the ninth value splits the leaf repeatedly until they are separated.
+	cells := make(map[string]s2.CellID, maxValuesPerCell+1)
+	moved := 0
+	for i := range maxValuesPerCell + 1 {
+		cellID := s2.CellIDFromLatLng(s2.LatLngFromDegrees(48.137+float64(i)*0.001, 11.575))
+		cells[strconv.Itoa(i)] = cellID
+		root.AddValue(&Value[int]{key: strconv.Itoa(i), cell: cellID}, func(*Value[int], *Node[int]) {
+			moved++
+		})
+	}
+	assert.GreaterOrEqual(t, moved, maxValuesPerCell)
+	assert.False(t, root.IsLeaveNode())
+
+	values := root.CollectValues(nil)
+	assert.Len(t, values, maxValuesPerCell+1)
+	for _, value := range values {
+		assert.Equal(t, cells[value.key], value.cell, value.key)
+	}
+}
@@ -0,0 +1,85 @@
+package go_sknn
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/geo/s2"
+)
+
+// SearchPool runs searches on a bounded number of workers.
+// If all workers are busy, further searches block until a worker is available,
+// which limits the number of concurrent searches and the memory they use.
+// Every worker reuses its search queue across searches.
+type SearchPool[T any] struct {
+	index   *KNN[T]
+	workers chan *searcher[T]
+}
+
+// NewSearchPool creates a search pool for the index with the given number of workers.
+// At least one worker is created.
+func (a *KNN[T]) NewSearchPool(workers int) *SearchPool[T] {
+	pool := &SearchPool[T]{
+		index:   a,
+		workers: make(chan *searcher[T], max(workers, 1)),
+	}
+	for range cap(pool.workers) {
+		pool.workers <- &searcher[T]{queue: newBinaryHeap[queueItem[T]]()}
+	}
+	return pool
+}
+
+// Search returns up to k values nearest to the given coordinates, ordered by distance.
+// It blocks until a worker is available and returns nil if the context is canceled while waiting.
+func (p *SearchPool[T]) Search(ctx context.Context, lat float64, long float64, k int) []*Value[T] {
+	var s *searcher[T]
+	select {
+	case s = <-p.workers:
+	case <-ctx.Done():
+		return nil
+	}
+	defer func() { p.workers <- s }()
+
+	s.reset(p.index, lat, long)
+	values := make([]*Value[T], 0, max(k, 0))
+	for len(values) < k {
+		value, _, ok := s.next(ctx)
+		if !ok {
+			break
+		}
+		values = append(values, value)
+	}
+	s.release()
+	return values
+}
+
+// BatchNearest returns the k nearest values of every point, ordered by distance. The result of a point has the
+// same index as the point. The points are searched independently, without sharing any traversal state, by a
+// worker pool of GOMAXPROCS workers. Every worker reuses its search queue across the points it searches,
+// which amortizes the setup of the searches. If the context is canceled, the results of the points which were
+// not searched yet are nil.
+func (a *KNN[T]) BatchNearest(ctx context.Context, points []s2.LatLng, k int) [][]*Value[T] {
+	results := make([][]*Value[T], len(points))
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for range min(runtime.GOMAXPROCS(0), len(points)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := &searcher[T]{queue: newBinaryHeap[queueItem[T]]()}
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= len(points) || ctx.Err() != nil {
+					break
+				}
+				s.reset(a, points[i].Lat.Degrees(), points[i].Lng.Degrees())
+				results[i] = resultValues(s.nearest(ctx, k))
+			}
+			s.release()
+		}()
+	}
+	wg.Wait()
+	return results
+}
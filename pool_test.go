@@ -0,0 +1,99 @@
+package go_sknn
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/geo/s2"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SearchPool(t *testing.T) {
+	index, err := BuildConcurrent(14, randomItems(10_000), 1)
+	assert.NoError(t, err)
+	pool := index.NewSearchPool(4)
+
+	r := rand.New(rand.NewSource(1))
+	type query struct {
+		lat, long float64
+		expected  []*Value[int]
+	}
+	queries := make([]query, 100)
+	for i := range queries {
+		queries[i].lat, queries[i].long = RandLat(r), RandLong(r)
+		index.Search(context.Background(), queries[i].lat, queries[i].long, func(value *Value[int]) bool {
+			queries[i].expected = append(queries[i].expected, value)
+			return len(queries[i].expected) >= 1+i%20
+		})
+	}
+
+	// Run more concurrent searches than workers, so the workers and their queues are reused.
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i, query := range queries {
+				assert.Equal(t, query.expected, pool.Search(context.Background(), query.lat, query.long, 1+i%20))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func Test_SearchPool_Backpressure(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	index.AddValue("1", 1, 1, 1)
+	pool := index.NewSearchPool(1)
+
+	// Occupy the only worker.
+	worker := <-pool.workers
+	done := make(chan []*Value[int])
+	go func() {
+		done <- pool.Search(context.Background(), 0, 0, 1)
+	}()
+	select {
+	case <-done:
+		t.Fatal("search did not wait for a free worker")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	pool.workers <- worker
+	result := <-done
+	assert.Len(t, result, 1)
+
+	// A canceled search doesn't wait for a worker.
+	worker = <-pool.workers
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Nil(t, pool.Search(ctx, 0, 0, 1))
+	pool.workers <- worker
+}
+
+func Test_KNN_BatchNearest(t *testing.T) {
+	index, err := BuildConcurrent(14, randomItems(10_000), 1)
+	assert.NoError(t, err)
+
+	r := rand.New(rand.NewSource(1))
+	points := make([]s2.LatLng, 100)
+	for i := range points {
+		points[i] = s2.LatLngFromDegrees(RandLat(r), RandLong(r))
+	}
+	results := index.BatchNearest(context.Background(), points, 5)
+	assert.Len(t, results, len(points))
+	for i, point := range points {
+		expected := index.Query(context.Background(), point.Lat.Degrees(), point.Lng.Degrees(), WithK[int](5))
+		assert.Equal(t, expected, results[i])
+	}
+
+	assert.Empty(t, index.BatchNearest(context.Background(), nil, 5))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, result := range index.BatchNearest(ctx, points, 5) {
+		assert.Nil(t, result)
+	}
+}
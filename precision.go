@@ -0,0 +1,48 @@
+package go_sknn
+
+import "github.com/golang/geo/s2"
+
+// EstimatePrecision estimates the precision for an index containing the given points, so that the leaves
+// hold about targetPerLeaf values. It returns the deepest level at which the cells containing points
+// hold at least targetPerLeaf points on average. Since only occupied cells are considered, the estimate
+// follows the local density of clustered data instead of the global average.
+//
+// The points can be a sample of the data, as long as targetPerLeaf is scaled accordingly.
+// A targetPerLeaf of 1 or less is reached at every level and results in the MaxPrecision.
+func EstimatePrecision(points []s2.LatLng, targetPerLeaf int) int {
+	if len(points) == 0 {
+		return MinPrecision
+	}
+	cellIDs := make([]s2.CellID, len(points))
+	for i, point := range points {
+		cellIDs[i] = s2.CellIDFromLatLng(point)
+	}
+
+	precision := MinPrecision
+	for level := MinPrecision; level <= MaxPrecision; level++ {
+		occupied := make(map[s2.CellID]struct{})
+		for _, cellID := range cellIDs {
+			occupied[cellID.Parent(level)] = struct{}{}
+		}
+		if float64(len(points))/float64(len(occupied)) < float64(targetPerLeaf) {
+			break
+		}
+		precision = level
+	}
+	return precision
+}
+
+// CellSizeKM2 returns the average area in square kilometers of a cell at the given precision,
+// following the S2 cell statistics, e.g. about 0.32 km² at precision 14.
+// The function panics if the precision is not between MinPrecision and MaxPrecision.
+func CellSizeKM2(precision int) float64 {
+	validateLevel(precision)
+	return s2.AvgAreaMetric.Value(precision) * earthRadiusKm * earthRadiusKm
+}
+
+// PrecisionForCellSizeKM2 returns the lowest precision whose cells have an average area of at most km2
+// square kilometers. Areas larger than a face cell result in MinPrecision, areas smaller than a leaf cell
+// in MaxPrecision.
+func PrecisionForCellSizeKM2(km2 float64) int {
+	return s2.AvgAreaMetric.MinLevel(km2 / (earthRadiusKm * earthRadiusKm))
+}
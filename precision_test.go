@@ -0,0 +1,63 @@
+package go_sknn
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/golang/geo/s2"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_EstimatePrecision(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	// Uniformly distributed points on the sphere.
+	points := make([]s2.LatLng, 100_000)
+	for i := range points {
+		points[i] = s2.LatLngFromPoint(s2.PointFromCoords(r.NormFloat64(), r.NormFloat64(), r.NormFloat64()))
+	}
+
+	for _, target := range []int{2, 8, 100, 1_000} {
+		// The 6 faces are split into 4 cells per level, so the expected level holds
+		// n / (6 * 4^level) >= target values per cell.
+		expected := int(math.Floor(math.Log(float64(len(points))/(6*float64(target))) / math.Log(4)))
+		assert.Equal(t, expected, EstimatePrecision(points, target), "target: %d", target)
+	}
+
+	// Clustered data needs a higher precision than uniform data with the same size.
+	clustered := make([]s2.LatLng, 100_000)
+	for i := range clustered {
+		clustered[i] = s2.LatLngFromDegrees(51+r.Float64()*0.1, 13+r.Float64()*0.1)
+	}
+	assert.Greater(t, EstimatePrecision(clustered, 8), EstimatePrecision(points, 8))
+
+	assert.Equal(t, MinPrecision, EstimatePrecision(nil, 8))
+	assert.Equal(t, MaxPrecision, EstimatePrecision(points[:1], 1))
+}
+
+func Test_CellSizeKM2(t *testing.T) {
+	// The average cell areas of the S2 cell statistics.
+	for precision, expected := range map[int]float64{
+		0:  85_011_012.19,
+		5:  83_018.57,
+		10: 81.07,
+		14: 0.32,
+		20: 0.000_077_3,
+		30: 0.74e-10,
+	} {
+		assert.InEpsilon(t, expected, CellSizeKM2(precision), 0.02, "precision: %d", precision)
+	}
+	assert.Panics(t, func() { CellSizeKM2(31) })
+}
+
+func Test_PrecisionForCellSizeKM2(t *testing.T) {
+	for precision := MinPrecision; precision <= MaxPrecision; precision++ {
+		size := CellSizeKM2(precision)
+		assert.Equal(t, precision, PrecisionForCellSizeKM2(size), "precision: %d", precision)
+		// Slightly smaller areas need the next precision.
+		assert.Equal(t, min(precision+1, MaxPrecision), PrecisionForCellSizeKM2(size*0.99), "precision: %d", precision)
+	}
+	assert.Equal(t, 14, PrecisionForCellSizeKM2(0.5))
+	assert.Equal(t, MinPrecision, PrecisionForCellSizeKM2(1e9))
+	assert.Equal(t, MaxPrecision, PrecisionForCellSizeKM2(0))
+}
@@ -0,0 +1,93 @@
+package go_sknn
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// QueryOption configures a Query.
+type QueryOption[T any] func(*query[T])
+
+// query holds the configuration of a Query.
+type query[T any] struct {
+	exact    bool
+	k        int
+	radiusKM float64
+	filter   func(*Value[T]) bool
+}
+
+// WithExact selects between the exact search, which returns the values ordered by distance,
+// and the approximate search, which returns all values of a leaf cell at the distance of the leaf cell.
+// Queries are exact by default.
+func WithExact[T any](exact bool) QueryOption[T] {
+	return func(q *query[T]) {
+		q.exact = exact
+	}
+}
+
+// WithK limits the query to the k nearest values. Without the option all values are returned.
+func WithK[T any](k int) QueryOption[T] {
+	return func(q *query[T]) {
+		q.k = k
+	}
+}
+
+// WithRadiusKM limits the query to the values within the radius in kilometers.
+// In an approximate query the radius is compared with the distance of the leaf cells,
+// so values of a leaf cell which intersects the radius can be slightly outside of it.
+func WithRadiusKM[T any](radiusKM float64) QueryOption[T] {
+	return func(q *query[T]) {
+		q.radiusKM = radiusKM
+	}
+}
+
+// WithFilter limits the query to the values for which filter returns true.
+// Filtered values don't count towards the k of WithK.
+func WithFilter[T any](filter func(*Value[T]) bool) QueryOption[T] {
+	return func(q *query[T]) {
+		q.filter = filter
+	}
+}
+
+// Query performs a nearest neighbor search configured by the options and returns the found values.
+// Without options it is an exact search returning all values of the index ordered by distance.
+func (a *KNN[T]) Query(ctx context.Context, lat float64, long float64, opts ...QueryOption[T]) []*Value[T] {
+	q := query[T]{exact: true, k: -1, radiusKM: math.Inf(1)}
+	for _, opt := range opts {
+		opt(&q)
+	}
+	if q.k == 0 {
+		return nil
+	}
+	var values []*Value[T]
+	a.query(ctx, lat, long, q, func(value *Value[T]) bool {
+		values = append(values, value)
+		return len(values) == q.k
+	})
+	return values
+}
+
+// query calls the callback with the values found by the query until the callback returns true.
+func (a *KNN[T]) query(ctx context.Context, lat float64, long float64, q query[T], callback func(*Value[T]) bool) {
+	if a.latency != nil {
+		defer a.recordLatency(time.Now())
+	}
+	s := a.newSearcher(lat, long)
+	s.coarse = !q.exact
+	if !math.IsInf(q.radiusKM, 1) {
+		s.limit = kmToChordAngle(q.radiusKM)
+	}
+	for {
+		value, _, ok := s.next(ctx)
+		if !ok {
+			return
+		}
+		if q.filter != nil && !q.filter(value) {
+			continue
+		}
+		if callback(value) {
+			return
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package go_sknn
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_KNN_Query(t *testing.T) {
+	index, err := BuildConcurrent(14, randomItems(10_000), 1)
+	assert.NoError(t, err)
+	searchLat, searchLong := 51.44, 13.55
+	var all []*Value[int]
+	index.Search(context.Background(), searchLat, searchLong, func(value *Value[int]) bool {
+		all = append(all, value)
+		return false
+	})
+
+	assert.Equal(t, all, index.Query(context.Background(), searchLat, searchLong))
+	assert.Equal(t, all[:10], index.Query(context.Background(), searchLat, searchLong, WithK[int](10)))
+	assert.Empty(t, index.Query(context.Background(), searchLat, searchLong, WithK[int](0)))
+
+	// The radius limits the exact query to the values inside the radius.
+	var inside []*Value[int]
+	for _, value := range all {
+		if value.DistanceKM(searchLat, searchLong) <= 500 {
+			inside = append(inside, value)
+		}
+	}
+	assert.NotEmpty(t, inside)
+	assert.Equal(t, inside, index.Query(context.Background(), searchLat, searchLong, WithRadiusKM[int](500)))
+
+	// The filter skips values without counting them.
+	even := func(value *Value[int]) bool { return value.Value()%2 == 0 }
+	var expected []*Value[int]
+	for _, value := range all {
+		if even(value) && len(expected) < 10 {
+			expected = append(expected, value)
+		}
+	}
+	assert.Equal(t, expected, index.Query(context.Background(), searchLat, searchLong, WithFilter(even), WithK[int](10)))
+
+	// The approximate query returns all values, but not strictly ordered by distance.
+	approximate := index.Query(context.Background(), searchLat, searchLong, WithExact[int](false))
+	assert.ElementsMatch(t, all, approximate)
+	assert.Len(t, index.Query(context.Background(), searchLat, searchLong, WithExact[int](false), WithK[int](10)), 10)
+	// Values of the leaf cells intersecting the radius are returned, which includes all values inside the radius.
+	assert.Subset(t, index.Query(context.Background(), searchLat, searchLong, WithExact[int](false), WithRadiusKM[int](500)), inside)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Empty(t, index.Query(ctx, searchLat, searchLong))
+}
@@ -0,0 +1,79 @@
+package go_sknn
+
+// priorityQueue is a queue which returns the item with the lowest priority first.
+type priorityQueue[E any] interface {
+	Push(item E, priority float64)
+	Pop() (item E, priority float64, ok bool)
+	Len() int
+	// Clear removes all items, but keeps the allocated memory for reuse.
+	Clear()
+}
+
+type heapEntry[E any] struct {
+	item     E
+	priority float64
+}
+
+// binaryHeap is the default priorityQueue implementation.
+// It stores the items by value, so no boxing is required.
+type binaryHeap[E any] struct {
+	entries []heapEntry[E]
+}
+
+func newBinaryHeap[E any]() *binaryHeap[E] {
+	return &binaryHeap[E]{}
+}
+
+func (h *binaryHeap[E]) Push(item E, priority float64) {
+	h.entries = append(h.entries, heapEntry[E]{item: item, priority: priority})
+	// Move the new entry up until its parent has a lower priority.
+	i := len(h.entries) - 1
+	for i > 0 {
+		parent := (i - 1) / 2
+		if h.entries[parent].priority <= h.entries[i].priority {
+			break
+		}
+		h.entries[parent], h.entries[i] = h.entries[i], h.entries[parent]
+		i = parent
+	}
+}
+
+func (h *binaryHeap[E]) Pop() (item E, priority float64, ok bool) {
+	if len(h.entries) == 0 {
+		return item, 0, false
+	}
+	top := h.entries[0]
+	last := len(h.entries) - 1
+	h.entries[0] = h.entries[last]
+	// Clear the moved entry, so the popped item can be garbage collected.
+	h.entries[last] = heapEntry[E]{}
+	h.entries = h.entries[:last]
+
+	// Move the new first entry down until both children have a higher priority.
+	i := 0
+	for {
+		smallest := i
+		left, right := 2*i+1, 2*i+2
+		if left < len(h.entries) && h.entries[left].priority < h.entries[smallest].priority {
+			smallest = left
+		}
+		if right < len(h.entries) && h.entries[right].priority < h.entries[smallest].priority {
+			smallest = right
+		}
+		if smallest == i {
+			break
+		}
+		h.entries[smallest], h.entries[i] = h.entries[i], h.entries[smallest]
+		i = smallest
+	}
+	return top.item, top.priority, true
+}
+
+func (h *binaryHeap[E]) Len() int {
+	return len(h.entries)
+}
+
+func (h *binaryHeap[E]) Clear() {
+	clear(h.entries)
+	h.entries = h.entries[:0]
+}
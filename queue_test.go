@@ -0,0 +1,36 @@
+package go_sknn
+
+import (
+	"math/rand"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_BinaryHeap(t *testing.T) {
+	var queue priorityQueue[int] = newBinaryHeap[int]()
+	_, _, ok := queue.Pop()
+	assert.False(t, ok)
+
+	r := rand.New(rand.NewSource(1))
+	priorities := make([]float64, 1_000)
+	for i := range priorities {
+		priorities[i] = float64(r.Intn(100))
+		queue.Push(i, priorities[i])
+	}
+	assert.Equal(t, 1_000, queue.Len())
+
+	sorted := slices.Clone(priorities)
+	slices.Sort(sorted)
+	for i := range sorted {
+		item, priority, ok := queue.Pop()
+		assert.True(t, ok)
+		assert.Equal(t, sorted[i], priority)
+		// The item is returned with the priority it was pushed with.
+		assert.Equal(t, priorities[item], priority)
+	}
+	assert.Equal(t, 0, queue.Len())
+	_, _, ok = queue.Pop()
+	assert.False(t, ok)
+}
@@ -0,0 +1,293 @@
+package go_sknn
+
+import (
+	"context"
+	"math"
+	"slices"
+
+	"github.com/golang/geo/s1"
+	"github.com/golang/geo/s2"
+)
+
+// SearchMetrics describes the work done by a single search.
+type SearchMetrics struct {
+	// NodesVisited is the number of tree nodes popped from the priority queue.
+	NodesVisited int
+	// ValuesVisited is the number of values popped from the priority queue.
+	ValuesVisited int
+	// MaxQueueDepth is the maximum number of items in the priority queue observed before popping an item.
+	MaxQueueDepth int
+	// AvgQueueDepth is the average number of items in the priority queue observed before popping an item.
+	AvgQueueDepth float64
+	// WastedValues is the number of values whose distance was computed and pushed to the priority queue,
+	// but which were not returned before the search ended.
+	WastedValues int
+}
+
+// searcher walks the search tree in order of increasing distance to a point.
+// Each call to next returns the next closest value.
+type searcher[T any] struct {
+	point   s2.Point
+	queue   priorityQueue[queueItem[T]]
+	metrics SearchMetrics
+	// trackLeaf enables recording the leaf node of every value in leaf.
+	trackLeaf bool
+	// leaf is the leaf node the last returned value was stored in.
+	leaf *Node[T]
+	// leafLevel is the level at which nodes are treated as leaves. All values below a node
+	// at this level are returned at the distance of the node without descending further.
+	leafLevel int
+	// limit is the maximum distance as chord angle. The search ends at the first node or value beyond the limit.
+	limit float64
+	// ringWidth enables the ring order if it is greater than 0. Nodes are queued by the ring they belong to
+	// instead of their distance, and all values of a leaf are queued with the ring of the leaf.
+	ringWidth float64
+	// coarse enables returning all values of a leaf at the distance of the leaf, without computing their own distance.
+	// The leaf of every value is recorded in leaf.
+	coarse bool
+	// visitSubtree is called for every expanded node at the level of the subtrees evicted to a node store,
+	// it loads the subtree if it is evicted. It is nil if the index has no node store.
+	visitSubtree      func(*Node[T])
+	visitSubtreeLevel int
+	// exclude skips all nodes completely inside the loop and all values inside the loop if it is set.
+	exclude *s2.Loop
+	// tieBreak orders values with the same distance if it is set.
+	tieBreak func(lhs *Value[T], rhs *Value[T]) int
+	// ties are the remaining values with the distance tieDistance, which are returned before the search continues.
+	ties        []queueItem[T]
+	tieDistance float64
+	// pops and queueDepthSum are the number of pops from the queue and the sum of the queue sizes before them.
+	pops          int
+	queueDepthSum int
+	// valuesQueued and valuesReturned are the number of values pushed to the queue and returned by next.
+	valuesQueued   int
+	valuesReturned int
+}
+
+// queueItem is either a node or a value in the search queue.
+type queueItem[T any] struct {
+	node  *Node[T]
+	value *Value[T]
+	// leaf is the leaf node of the value, it is only set if the leaf is tracked.
+	leaf *Node[T]
+}
+
+func (a *KNN[T]) newSearcher(lat float64, long float64) *searcher[T] {
+	s := &searcher[T]{queue: newBinaryHeap[queueItem[T]]()}
+	s.reset(a, lat, long)
+	return s
+}
+
+// reset prepares the searcher for a new search in the index, reusing the memory of the queue.
+func (s *searcher[T]) reset(a *KNN[T], lat float64, long float64) {
+	s.queue.Clear()
+	*s = searcher[T]{
+		point: s2.PointFromLatLng(s2.LatLngFromDegrees(lat, long)),
+		queue: s.queue,
+		// Nodes can't be deeper than the max precision, so no node is cut off.
+		leafLevel: MaxPrecision + 1,
+		limit:     math.Inf(1),
+		tieBreak:  a.tieBreak,
+	}
+	if a.spill != nil {
+		s.visitSubtree, s.visitSubtreeLevel = a.visitSubtree, a.spill.level
+	}
+	s.queue.Push(queueItem[T]{node: a.indexRoot}, 0)
+}
+
+// release releases the references of a reused searcher to the tree, so they don't outlive the search.
+func (s *searcher[T]) release() {
+	s.queue.Clear()
+}
+
+// next returns the next closest value and its distance as chord angle.
+// It returns false if there are no more values or if the context is canceled.
+func (s *searcher[T]) next(ctx context.Context) (*Value[T], float64, bool) {
+	for {
+		if ctx.Err() != nil {
+			return nil, 0, false
+		}
+		if len(s.ties) > 0 {
+			tie := s.ties[0]
+			s.ties = s.ties[1:]
+			s.leaf = tie.leaf
+			s.valuesReturned++
+			return tie.value, s.tieDistance, true
+		}
+		s.recordQueueDepth()
+		popped, distance, ok := s.queue.Pop()
+		if !ok {
+			return nil, 0, false
+		}
+		// The distance of a node is a lower bound for all values in it, so nothing closer follows.
+		// The item is pushed back, so the search can be continued with a greater limit.
+		if distance > s.limit {
+			s.queue.Push(popped, distance)
+			return nil, 0, false
+		}
+		switch {
+		case popped.node != nil:
+			s.metrics.NodesVisited++
+			s.expand(popped.node, distance)
+		case popped.value != nil && s.tieBreak != nil:
+			s.collectTies(popped, distance)
+		case popped.value != nil:
+			s.metrics.ValuesVisited++
+			s.leaf = popped.leaf
+			s.valuesReturned++
+			return popped.value, distance, true
+		default:
+			// Only nodes and values are pushed to the queue, anything else is a bug which would silently drop results.
+			panic("unexpected empty item in the search queue")
+		}
+	}
+}
+
+// collectTies collects all values with the same distance as the popped value into ties, ordered by the tie break.
+// Nodes with the same distance are expanded, because they can contain values with the same distance.
+func (s *searcher[T]) collectTies(popped queueItem[T], distance float64) {
+	ties := append(s.ties[:0], popped)
+	for {
+		s.recordQueueDepth()
+		item, priority, ok := s.queue.Pop()
+		if !ok {
+			break
+		}
+		if priority != distance {
+			s.queue.Push(item, priority)
+			break
+		}
+		if item.node != nil {
+			s.metrics.NodesVisited++
+			s.expand(item.node, priority)
+			continue
+		}
+		ties = append(ties, item)
+	}
+	s.metrics.ValuesVisited += len(ties)
+	slices.SortStableFunc(ties, func(lhs, rhs queueItem[T]) int {
+		return s.tieBreak(lhs.value, rhs.value)
+	})
+	s.ties, s.tieDistance = ties, distance
+}
+
+// expand pushes the children or the values of a node popped with the given priority to the queue.
+func (s *searcher[T]) expand(node *Node[T], priority float64) {
+	if s.visitSubtree != nil && node.Level() == s.visitSubtreeLevel {
+		s.visitSubtree(node)
+	}
+	if node.Level() >= s.leafLevel {
+		// All values below the leaf level are returned at the distance of the node.
+		for _, value := range node.CollectValues(nil) {
+			s.queueValue(queueItem[T]{value: value}, priority)
+		}
+		return
+	}
+	isLeaf := node.visitLeaf(func(value *Value[T]) {
+		s.pushLeafValue(node, value, priority)
+	})
+	if !isLeaf {
+		node.AddChildrenToQueue(s.point, s.pushNode)
+	}
+}
+
+// pushLeafValue pushes a value of the leaf popped with the given priority to the queue.
+func (s *searcher[T]) pushLeafValue(leaf *Node[T], value *Value[T], priority float64) {
+	switch {
+	case s.ringWidth > 0:
+		// All values of a leaf belong to the ring of the leaf.
+		s.queueValue(queueItem[T]{value: value}, priority)
+	case s.coarse:
+		s.queueValue(queueItem[T]{value: value, leaf: leaf}, priority)
+	case s.trackLeaf:
+		s.queueValue(queueItem[T]{value: value, leaf: leaf}, float64(s2.CellFromCellID(value.cell).Distance(s.point)))
+	default:
+		s.pushValue(value, float64(s2.CellFromCellID(value.cell).Distance(s.point)))
+	}
+}
+
+// pushNode pushes a node with its distance to the queue. In the ring order the ring of the node is used as priority.
+// Excluded nodes are not pushed.
+func (s *searcher[T]) pushNode(node *Node[T], distance float64) {
+	if s.exclude != nil && s.exclude.ContainsCell(s2.CellFromCellID(node.cellID)) {
+		return
+	}
+	if s.ringWidth > 0 {
+		distance = math.Floor(chordAngleToKM(distance) / s.ringWidth)
+	}
+	s.queue.Push(queueItem[T]{node: node}, distance)
+}
+
+// pushValue pushes a value with its distance to the queue.
+func (s *searcher[T]) pushValue(value *Value[T], distance float64) {
+	s.queueValue(queueItem[T]{value: value}, distance)
+}
+
+// queueValue pushes a value item to the queue and counts it for the wasted work metric.
+// Excluded values are not pushed.
+func (s *searcher[T]) queueValue(item queueItem[T], priority float64) {
+	if s.exclude != nil && s.exclude.ContainsPoint(item.value.cell.Point()) {
+		return
+	}
+	s.valuesQueued++
+	s.queue.Push(item, priority)
+}
+
+// recordQueueDepth records the size of the queue before a pop for the queue depth metrics.
+func (s *searcher[T]) recordQueueDepth() {
+	depth := s.queue.Len()
+	if depth == 0 {
+		return
+	}
+	s.pops++
+	s.queueDepthSum += depth
+	s.metrics.MaxQueueDepth = max(s.metrics.MaxQueueDepth, depth)
+}
+
+// searchMetrics returns the metrics of the search so far.
+func (s *searcher[T]) searchMetrics() SearchMetrics {
+	metrics := s.metrics
+	if s.pops > 0 {
+		metrics.AvgQueueDepth = float64(s.queueDepthSum) / float64(s.pops)
+	}
+	metrics.WastedValues = s.valuesQueued - s.valuesReturned
+	return metrics
+}
+
+// chordAngleToKM converts a distance on the unit sphere, given as chord angle, to kilometers on the earth surface.
+func chordAngleToKM(distance float64) float64 {
+	return s1.ChordAngle(distance).Angle().Radians() * earthRadiusKm
+}
+
+// searchResult is a value found by a search together with its distance as chord angle.
+type searchResult[T any] struct {
+	value    *Value[T]
+	distance float64
+}
+
+// resultValues returns the values of the results in the same order.
+func resultValues[T any](results []searchResult[T]) []*Value[T] {
+	values := make([]*Value[T], len(results))
+	for i, result := range results {
+		values[i] = result.value
+	}
+	return values
+}
+
+// nearest returns up to k next closest values of the search.
+func (s *searcher[T]) nearest(ctx context.Context, k int) []searchResult[T] {
+	results := make([]searchResult[T], 0, max(k, 0))
+	for len(results) < k {
+		value, distance, ok := s.next(ctx)
+		if !ok {
+			break
+		}
+		results = append(results, searchResult[T]{value: value, distance: distance})
+	}
+	return results
+}
+
+// kmToChordAngle converts a distance in kilometers on the earth surface to a chord angle on the unit sphere.
+func kmToChordAngle(km float64) float64 {
+	return float64(s1.ChordAngleFromAngle(s1.Angle(km / earthRadiusKm)))
+}
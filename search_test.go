@@ -0,0 +1,58 @@
+package go_sknn
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Searcher_UnexpectedItem(t *testing.T) {
+	index, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	index.AddValue("1", 1, 1, 1)
+
+	s := index.newSearcher(1, 1)
+	s.queue.Push(queueItem[int]{}, 0)
+	assert.PanicsWithValue(t, "unexpected empty item in the search queue", func() {
+		s.next(context.Background())
+	})
+}
+
+func Test_KNN_SearchWithMetrics_QueueDepth(t *testing.T) {
+	index, err := BuildConcurrent(14, randomItems(10_000), 1)
+	assert.NoError(t, err)
+
+	search := func(k int) SearchMetrics {
+		results := 0
+		return index.SearchWithMetrics(context.Background(), 51.44, 13.55, func(*Value[int]) bool {
+			results++
+			return results >= k
+		})
+	}
+	// All values are returned, so no computed distance is wasted.
+	full := search(10_000)
+	assert.Equal(t, 10_000, full.ValuesVisited)
+	assert.Zero(t, full.WastedValues)
+	assert.Greater(t, full.MaxQueueDepth, 0)
+	assert.Greater(t, full.AvgQueueDepth, 0.0)
+	assert.LessOrEqual(t, full.AvgQueueDepth, float64(full.MaxQueueDepth))
+
+	for _, k := range []int{1, 10, 100} {
+		metrics := search(k)
+		assert.Equal(t, k, metrics.ValuesVisited)
+		assert.Greater(t, metrics.WastedValues, 0, "k: %d", k)
+		assert.LessOrEqual(t, metrics.AvgQueueDepth, float64(metrics.MaxQueueDepth))
+	}
+
+	// A full scan grows the queue beyond the peak of a local query.
+	local := search(10)
+	assert.Greater(t, local.MaxQueueDepth, 0)
+	assert.Greater(t, full.MaxQueueDepth, local.MaxQueueDepth)
+
+	// The peak is at least the size of the queue left behind by the search.
+	s := index.newSearcher(51.44, 13.55)
+	s.nearest(context.Background(), 10)
+	assert.LessOrEqual(t, s.queue.Len(), s.searchMetrics().MaxQueueDepth)
+	assert.Equal(t, local.MaxQueueDepth, s.searchMetrics().MaxQueueDepth)
+}
@@ -0,0 +1,272 @@
+package go_sknn
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/gob"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/golang/geo/s2"
+)
+
+// NodeStore stores serialized subtrees of the index, which are evicted from memory by WithNodeStore.
+type NodeStore interface {
+	// Put stores the serialized subtree of the cell, replacing a previously stored subtree of the cell.
+	Put(cellID s2.CellID, data []byte) error
+	// Get returns the serialized subtree of the cell.
+	Get(cellID s2.CellID) ([]byte, error)
+}
+
+// spillState tracks the subtrees which can be evicted to the node store.
+type spillState struct {
+	store NodeStore
+	// level is the level of the root nodes of the evictable subtrees.
+	level int
+	// maxResident is the number of subtrees which are kept in memory.
+	maxResident int
+	// mutex guards the fields below. If the lookup lock of the index is needed too, it is taken first.
+	mutex sync.Mutex
+	// tick is increased by every search visiting a subtree, lastUsed holds the tick of the last visit of a subtree.
+	tick     uint64
+	lastUsed map[s2.CellID]uint64
+	// err is the first error of the node store.
+	err error
+}
+
+// spilledValue is the serialized form of a value in a subtree evicted to the node store.
+type spilledValue[T any] struct {
+	Key      string
+	Value    T
+	Cell     s2.CellID
+	AddedAt  time.Time
+	Sequence uint64
+}
+
+// WithNodeStore enables evicting subtrees to the node store to limit the memory of very large indexes.
+// The subtrees are rooted at the nodes at the given level and at most maxResident of them are kept in memory.
+// When a search reaches an evicted subtree it is loaded from the store, and the least recently searched
+// subtrees are evicted to make room. Adding, updating, removing or looking up a value by its id loads the
+// subtree of the value, too. EvictColdSubtrees evicts subtrees explicitly, e.g. after adding many values.
+//
+// Methods walking the whole tree, like Count, Fingerprint or the aggregates, and searches which don't descend
+// to the level of the subtrees only see the values of the subtrees in memory.
+// Errors of the store are reported by NodeStoreError, a subtree which can't be stored stays in memory.
+func WithNodeStore[T any](store NodeStore, level int, maxResident int) Option[T] {
+	return func(a *KNN[T]) {
+		a.spill = &spillState{store: store, level: level, maxResident: max(maxResident, 1), lastUsed: make(map[s2.CellID]uint64)}
+	}
+}
+
+// NodeStoreError returns the first error of the node store or nil if there was none.
+func (a *KNN[T]) NodeStoreError() error {
+	if a.spill == nil {
+		return nil
+	}
+	a.spill.mutex.Lock()
+	defer a.spill.mutex.Unlock()
+	return a.spill.err
+}
+
+// recordStoreError records the first error of the node store. The caller must hold the spill lock.
+func (s *spillState) recordStoreError(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// EvictColdSubtrees evicts all subtrees to the node store except the keep most recently searched ones.
+// It returns the first error of the node store, the subtrees which could not be stored stay in memory.
+func (a *KNN[T]) EvictColdSubtrees(keep int) error {
+	if a.spill == nil {
+		return nil
+	}
+	a.lookupMutex.Lock()
+	defer a.lookupMutex.Unlock()
+	a.spill.mutex.Lock()
+	defer a.spill.mutex.Unlock()
+	return a.evict(max(keep, 0), nil)
+}
+
+// residentSubtrees returns the root nodes of the subtrees in memory.
+func (a *KNN[T]) residentSubtrees() []*Node[T] {
+	var nodes []*Node[T]
+	a.indexRoot.WalkNodes(func(node *Node[T]) bool {
+		if node.Level() < a.spill.level {
+			return true
+		}
+		if !node.isSpilled() {
+			nodes = append(nodes, node)
+		}
+		return false
+	})
+	return nodes
+}
+
+// evict evicts the least recently searched subtrees until at most keep subtrees are in memory.
+// The subtree of except is never evicted. The caller must hold the lookup lock and the spill lock.
+func (a *KNN[T]) evict(keep int, except *Node[T]) error {
+	nodes := a.residentSubtrees()
+	if len(nodes) <= keep {
+		return nil
+	}
+	slices.SortStableFunc(nodes, func(lhs, rhs *Node[T]) int {
+		return cmp.Compare(a.spill.lastUsed[rhs.cellID], a.spill.lastUsed[lhs.cellID])
+	})
+	var firstErr error
+	for _, node := range nodes[keep:] {
+		if node == except {
+			continue
+		}
+		if err := a.evictNode(node); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		a.spill.recordStoreError(firstErr)
+	}
+	return firstErr
+}
+
+// evictNode stores the subtree of the node and removes it from memory. The lookup entries of its values point
+// to the node, so the subtree is loaded when a value is accessed by its id. The caller must hold the lookup lock.
+func (a *KNN[T]) evictNode(node *Node[T]) error {
+	values := node.CollectValues(nil)
+	spilled := make([]spilledValue[T], len(values))
+	for i, value := range values {
+		spilled[i] = spilledValue[T]{Key: value.key, Value: value.value, Cell: value.cell, AddedAt: value.addedAt, Sequence: value.sequence}
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(spilled); err != nil {
+		return fmt.Errorf("encode subtree %s: %w", node.cellID, err)
+	}
+	if err := a.spill.store.Put(node.cellID, buf.Bytes()); err != nil {
+		return fmt.Errorf("store subtree %s: %w", node.cellID, err)
+	}
+
+	node.valuesMutex.Lock()
+	node.childMutex.Lock()
+	node.children = nil
+	node.values = nil
+	node.slab = nil
+	node.spilled = true
+	node.childMutex.Unlock()
+	node.valuesMutex.Unlock()
+	for _, value := range values {
+		a.lookup[value.key] = node
+	}
+	return nil
+}
+
+// loadNode loads the evicted subtree of the node from the node store and evicts other subtrees if more than
+// the maximum are in memory. The caller must hold the lookup lock.
+func (a *KNN[T]) loadNode(node *Node[T]) {
+	a.spill.mutex.Lock()
+	defer a.spill.mutex.Unlock()
+	if a.loadSubtree(node) {
+		_ = a.evict(a.spill.maxResident, node)
+	}
+}
+
+// loadAll loads all evicted subtrees without evicting others. The caller must hold the lookup lock.
+func (a *KNN[T]) loadAll() {
+	if a.spill == nil {
+		return
+	}
+	a.spill.mutex.Lock()
+	defer a.spill.mutex.Unlock()
+	var spilled []*Node[T]
+	a.indexRoot.WalkNodes(func(node *Node[T]) bool {
+		if node.isSpilled() {
+			spilled = append(spilled, node)
+		}
+		return node.Level() < a.spill.level
+	})
+	for _, node := range spilled {
+		a.loadSubtree(node)
+	}
+}
+
+// loadSubtree loads the evicted subtree of the node from the node store and returns true if it was loaded.
+// The caller must hold the lookup lock and the spill lock.
+func (a *KNN[T]) loadSubtree(node *Node[T]) bool {
+	if !node.isSpilled() {
+		return false
+	}
+	data, err := a.spill.store.Get(node.cellID)
+	if err != nil {
+		a.spill.recordStoreError(fmt.Errorf("load subtree %s: %w", node.cellID, err))
+		return false
+	}
+	var spilled []spilledValue[T]
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&spilled); err != nil {
+		a.spill.recordStoreError(fmt.Errorf("decode subtree %s: %w", node.cellID, err))
+		return false
+	}
+
+	node.valuesMutex.Lock()
+	node.childMutex.Lock()
+	node.spilled = false
+	node.childMutex.Unlock()
+	node.valuesMutex.Unlock()
+	for _, value := range spilled {
+		insertValue(node, a.lookup, &Value[T]{key: value.Key, value: value.Value, cell: value.Cell, addedAt: value.AddedAt, sequence: value.Sequence})
+	}
+	a.spill.tick++
+	a.spill.lastUsed[node.cellID] = a.spill.tick
+	return true
+}
+
+// visitSubtree records a search visiting the node at the level of the evictable subtrees and loads it if it is evicted.
+func (a *KNN[T]) visitSubtree(node *Node[T]) {
+	if node.isSpilled() {
+		a.lookupMutex.Lock()
+		a.loadNode(node)
+		a.lookupMutex.Unlock()
+		return
+	}
+	a.spill.mutex.Lock()
+	a.spill.tick++
+	a.spill.lastUsed[node.cellID] = a.spill.tick
+	a.spill.mutex.Unlock()
+}
+
+// lockLookup takes the lookup lock to access the value of an id and returns the function releasing it. If the index
+// has a node store the write lock is taken, so the evicted subtree of the value can be loaded and accessed under
+// the same lock, without a concurrent search evicting it again in between.
+func (a *KNN[T]) lockLookup() (unlock func()) {
+	if a.spill == nil {
+		a.lookupMutex.RLock()
+		return a.lookupMutex.RUnlock
+	}
+	a.lookupMutex.Lock()
+	return a.lookupMutex.Unlock
+}
+
+// nodeOf returns the node holding the value of id and loads its subtree if it is evicted. It returns false if
+// the id does not exist. The caller must hold the lookup lock, the write lock if the index has a node store.
+func (a *KNN[T]) nodeOf(id string) (*Node[T], bool) {
+	node, ok := a.lookup[id]
+	if ok && a.spill != nil && node.isSpilled() {
+		a.loadNode(node)
+		node = a.lookup[id]
+	}
+	return node, ok
+}
+
+// loadCell loads the evicted subtree containing the cell, so a value can be added to it.
+// The caller must hold the lookup lock.
+func (a *KNN[T]) loadCell(cellID s2.CellID) {
+	if a.spill == nil {
+		return
+	}
+	node := a.indexRoot
+	for node != nil && node.Level() < a.spill.level {
+		node = node.ChildContaining(cellID)
+	}
+	if node != nil && node.isSpilled() {
+		a.loadNode(node)
+	}
+}
@@ -0,0 +1,180 @@
+package go_sknn
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/golang/geo/s2"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryNodeStore is a node store keeping the subtrees in memory.
+type memoryNodeStore struct {
+	mutex    sync.Mutex
+	subtrees map[s2.CellID][]byte
+	puts     int
+	gets     int
+	failPut  bool
+}
+
+func newMemoryNodeStore() *memoryNodeStore {
+	return &memoryNodeStore{subtrees: make(map[s2.CellID][]byte)}
+}
+
+func (m *memoryNodeStore) Put(cellID s2.CellID, data []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.failPut {
+		return errors.New("disk full")
+	}
+	m.puts++
+	m.subtrees[cellID] = data
+	return nil
+}
+
+func (m *memoryNodeStore) Get(cellID s2.CellID) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	data, ok := m.subtrees[cellID]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	m.gets++
+	return data, nil
+}
+
+func Test_KNN_WithNodeStore(t *testing.T) {
+	store := newMemoryNodeStore()
+	index, err := NewKNN[int](14, WithNodeStore[int](store, 2, 4))
+	assert.NoError(t, err)
+	reference, err := NewKNN[int](14)
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	for i := range 10_000 {
+		lat, long := RandLat(r), RandLong(r)
+		index.AddValue(strconv.Itoa(i), i, lat, long)
+		reference.AddValue(strconv.Itoa(i), i, lat, long)
+	}
+
+	// Evict all subtrees, only the nodes above the subtrees stay in memory.
+	assert.NoError(t, index.EvictColdSubtrees(0))
+	assert.Zero(t, index.Count())
+	assert.Greater(t, store.puts, 0)
+
+	for i := range 50 {
+		lat, long := RandLat(r), RandLong(r)
+		k := 1 + i*10
+		expected := reference.Query(context.Background(), lat, long, WithK[int](k))
+		actual := index.Query(context.Background(), lat, long, WithK[int](k))
+		assert.Equal(t, len(expected), len(actual))
+		for j := range min(len(expected), len(actual)) {
+			assert.Equal(t, expected[j].Key(), actual[j].Key())
+			assert.Equal(t, expected[j].Value(), actual[j].Value())
+			assert.Equal(t, expected[j].CellID(), actual[j].CellID())
+		}
+		// Searches load the subtrees they visit and evict the least recently searched ones.
+		assert.LessOrEqual(t, len(index.residentSubtrees()), 4)
+		if i%10 == 0 {
+			assert.NoError(t, index.EvictColdSubtrees(0))
+		}
+	}
+	assert.Greater(t, store.gets, 0)
+
+	// Accessing evicted values by their id loads their subtree.
+	assert.NoError(t, index.EvictColdSubtrees(0))
+	assert.True(t, index.UpdatePayload("1", -1))
+	assert.Equal(t, -1, index.findValue("1").Value())
+	assert.NoError(t, index.EvictColdSubtrees(0))
+	assert.True(t, index.RemoveValue("2"))
+	assert.NoError(t, index.EvictColdSubtrees(0))
+	index.UpsertValue("3", -3, 1, 1)
+	old, existed := index.SwapValue("4", -4, 2, 2)
+	assert.True(t, existed)
+	assert.Equal(t, 4, old.Value())
+	assert.NoError(t, index.EvictColdSubtrees(0))
+	index.AddValue("new", 0, 48.137, 11.575)
+	assert.NoError(t, index.EvictColdSubtrees(0))
+	// Pruning keeps the evicted subtrees.
+	index.Prune()
+
+	// Rebuilding the tree loads all subtrees.
+	shards := index.Shard(1)
+	assert.Equal(t, 10_000, shards[0].Count())
+	assert.Equal(t, -1, shards[0].findValue("1").Value())
+	assert.False(t, shards[0].HasValue("2"))
+	assert.Equal(t, -3, shards[0].findValue("3").Value())
+	assert.Equal(t, -4, shards[0].findValue("4").Value())
+	assert.True(t, shards[0].HasValue("new"))
+	assert.NoError(t, index.NodeStoreError())
+}
+
+func Test_KNN_WithNodeStore_ConcurrentSearch(t *testing.T) {
+	store := newMemoryNodeStore()
+	index, err := NewKNN[int](14, WithNodeStore[int](store, 2, 1))
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	for i := range 1_000 {
+		index.AddValue(strconv.Itoa(i), i, RandLat(r), RandLong(r))
+	}
+	// Evicted nodes keep their parent, so a search still holding them reads their level.
+	var children []*Node[int]
+	index.indexRoot.WalkNodes(func(node *Node[int]) bool {
+		if node.Level() == 3 {
+			children = append(children, node)
+		}
+		return node.Level() < 3
+	})
+	assert.NotEmpty(t, children)
+	assert.NoError(t, index.EvictColdSubtrees(0))
+	for _, child := range children {
+		assert.Equal(t, 3, child.Level())
+	}
+
+	// Searches load and evict the subtrees all the time, values accessed by their id must always be found.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		r := rand.New(rand.NewSource(2))
+		for range 500 {
+			index.KNearest(context.Background(), RandLat(r), RandLong(r), 5)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := range 2_000 {
+			id := strconv.Itoa(i % 1_000)
+			value, ok := index.GetValue(id)
+			assert.True(t, ok, id)
+			assert.Equal(t, i%1_000, max(value, -value), id)
+			assert.True(t, index.UpdatePayload(id, -(i%1_000)), id)
+			_, _, ok = index.GetLocation(id)
+			assert.True(t, ok, id)
+		}
+	}()
+	wg.Wait()
+	assert.Equal(t, 1_000, index.Len())
+	assert.NoError(t, index.NodeStoreError())
+}
+
+func Test_KNN_WithNodeStore_Errors(t *testing.T) {
+	_, err := NewKNN[int](10, WithNodeStore[int](newMemoryNodeStore(), 11, 4))
+	assert.EqualError(t, err, "invalid node store level 11: level must be between 0 and 10")
+
+	store := newMemoryNodeStore()
+	index, err := NewKNN[int](10, WithNodeStore[int](store, 2, 4))
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	for i := range 1000 {
+		index.AddValue(strconv.Itoa(i), i, RandLat(r), RandLong(r))
+	}
+	store.failPut = true
+	// The subtree which can't be stored stays in memory.
+	assert.ErrorContains(t, index.EvictColdSubtrees(0), "disk full")
+	assert.ErrorContains(t, index.NodeStoreError(), "disk full")
+	assert.Equal(t, 1000, index.Count())
+}
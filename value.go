@@ -1,15 +1,22 @@
 package go_sknn
 
 import (
+	"math"
+	"time"
+
+	"github.com/golang/geo/s1"
 	"github.com/golang/geo/s2"
 )
 
 const earthRadiusKm = 6371.01
 
 type Value[T any] struct {
-	key   string
-	value T
-	cell  s2.CellID
+	key     string
+	value   T
+	cell    s2.CellID
+	addedAt time.Time
+	// sequence is the position of the value in the insertion order of the index.
+	sequence uint64
 }
 
 func (v *Value[T]) Value() T {
@@ -24,6 +31,57 @@ func (v *Value[T]) CellID() s2.CellID {
 	return v.cell
 }
 
+// Cell returns the S2 cell of the value.
+func (v *Value[T]) Cell() s2.Cell {
+	return s2.CellFromCellID(v.cell)
+}
+
+// LatLng returns the coordinates of the value in degrees. They are the center of the leaf cell the value is
+// stored with, not the exact inserted coordinates, but differ from them by less than a centimeter.
+func (v *Value[T]) LatLng() (lat, long float64) {
+	latLng := v.cell.LatLng()
+	return latLng.Lat.Degrees(), latLng.Lng.Degrees()
+}
+
+// CellAtLevel returns the cell at the given level containing the value, e.g. to draw the boundary of the
+// enclosing cell. The cell of the value itself is a leaf cell at the MaxPrecision.
+// The function panics if the level is not a valid S2 level.
+func (v *Value[T]) CellAtLevel(level int) s2.Cell {
+	validateLevel(level)
+	return s2.CellFromCellID(v.cell.Parent(level))
+}
+
+// AddedAt returns the time the value was added to the index.
+func (v *Value[T]) AddedAt() time.Time {
+	return v.addedAt
+}
+
+// DistanceKM returns the great-circle distance in kilometers between the value and the coordinates.
+// The value is stored with the leaf cell of its coordinates, not a cell at the precision of the index,
+// so the distance is accurate within a centimeter at every precision.
 func (v *Value[T]) DistanceKM(lat, long float64) float64 {
 	return float64(s2.LatLngFromDegrees(lat, long).Distance(v.cell.LatLng())) * earthRadiusKm
 }
+
+// DistanceKM returns the great-circle distance in kilometers between two coordinates.
+func DistanceKM(lat1, long1, lat2, long2 float64) float64 {
+	return float64(s2.LatLngFromDegrees(lat1, long1).Distance(s2.LatLngFromDegrees(lat2, long2))) * earthRadiusKm
+}
+
+// bearingDeg returns the initial bearing in degrees of the great circle from one coordinate to another,
+// measured clockwise from north in the range [0, 360).
+func bearingDeg(from s2.LatLng, to s2.LatLng) float64 {
+	deltaLong := float64(to.Lng - from.Lng)
+	y := math.Sin(deltaLong) * math.Cos(float64(to.Lat))
+	x := math.Cos(float64(from.Lat))*math.Sin(float64(to.Lat)) - math.Sin(float64(from.Lat))*math.Cos(float64(to.Lat))*math.Cos(deltaLong)
+	return normalizeDeg(s1.Angle(math.Atan2(y, x)).Degrees())
+}
+
+// normalizeDeg maps an angle in degrees to the range [0, 360).
+func normalizeDeg(deg float64) float64 {
+	deg = math.Mod(deg, 360)
+	if deg < 0 {
+		deg += 360
+	}
+	return deg
+}
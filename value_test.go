@@ -0,0 +1,41 @@
+package go_sknn
+
+import (
+	"testing"
+
+	"github.com/golang/geo/s2"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DistanceKM(t *testing.T) {
+	// Berlin to Paris is about 878 km.
+	assert.InDelta(t, 878, DistanceKM(52.5200, 13.4050, 48.8566, 2.3522), 1)
+	assert.InDelta(t, 878, DistanceKM(48.8566, 2.3522, 52.5200, 13.4050), 1)
+	assert.Equal(t, 0.0, DistanceKM(51.0504, 13.7373, 51.0504, 13.7373))
+	// Half the circumference of the earth.
+	assert.InDelta(t, 20_015, DistanceKM(0, 0, 0, 180), 1)
+}
+
+func Test_Value_Cell(t *testing.T) {
+	cellID := s2.CellIDFromLatLng(s2.LatLngFromDegrees(51.0504, 13.7373))
+	value := &Value[int]{key: "1", value: 1, cell: cellID}
+	cell := value.Cell()
+	assert.Equal(t, cellID, cell.ID())
+	assert.Equal(t, MaxPrecision, cell.Level())
+	assert.True(t, cell.ContainsPoint(cellID.Point()))
+
+	parent := value.CellAtLevel(10)
+	assert.Equal(t, 10, parent.Level())
+	assert.Equal(t, cellID.Parent(10), parent.ID())
+	assert.True(t, parent.ContainsCell(cell))
+	assert.Equal(t, cell, value.CellAtLevel(MaxPrecision))
+	assert.Panics(t, func() { value.CellAtLevel(31) })
+}
+
+func Test_Value_LatLng(t *testing.T) {
+	value := &Value[int]{key: "1", value: 1, cell: s2.CellIDFromLatLng(s2.LatLngFromDegrees(51.0504, 13.7373))}
+	lat, long := value.LatLng()
+	assert.InDelta(t, 51.0504, lat, 1e-7)
+	assert.InDelta(t, 13.7373, long, 1e-7)
+	assert.Less(t, DistanceKM(51.0504, 13.7373, lat, long), 1e-5)
+}
@@ -0,0 +1,167 @@
+package go_sknn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+)
+
+// walOp is the operation of a write-ahead log record.
+type walOp byte
+
+const (
+	walAdd walOp = iota + 1
+	walRemove
+	walUpsert
+)
+
+// maxWALRecordSize is the maximum length of a record accepted by ReplayWAL. A greater length can only be read
+// from a corrupt log, and allocating it could exhaust the memory.
+const maxWALRecordSize = 64 << 20
+
+// walWriter appends records to the write-ahead log. Writes are serialized, so records are never interleaved.
+type walWriter struct {
+	mutex sync.Mutex
+	w     io.Writer
+	// err is the first error writing to the log. No records are written after an error.
+	err error
+}
+
+// WithWAL enables the write-ahead log. Every AddValue, RemoveValue and UpsertValue is appended to w
+// as a record after it was applied to the index, so the index can be recovered with ReplayWAL. The record is
+// appended while the index is still locked, so concurrent changes are logged in the order they were applied.
+// AddValues, BuildConcurrent and BuildParallel append an add record for every value. Other changes of the
+// index, like UpdatePayload, Transform or values added by a Builder, are not logged.
+//
+// A record consists of its length as big endian uint32, followed by the operation, the id,
+// the coordinates and the gob encoded value. Errors writing to w are reported by WALError.
+func WithWAL[T any](w io.Writer) Option[T] {
+	return func(a *KNN[T]) {
+		a.wal = &walWriter{w: w}
+	}
+}
+
+// WALError returns the first error writing to the write-ahead log or nil if there was none.
+// After an error no further records are written.
+func (a *KNN[T]) WALError() error {
+	if a.wal == nil {
+		return nil
+	}
+	a.wal.mutex.Lock()
+	defer a.wal.mutex.Unlock()
+	return a.wal.err
+}
+
+// logWAL appends a record to the write-ahead log if it is enabled.
+func (a *KNN[T]) logWAL(op walOp, id string, value T, lat float64, long float64) {
+	if a.wal == nil {
+		return
+	}
+	a.wal.mutex.Lock()
+	defer a.wal.mutex.Unlock()
+	if a.wal.err != nil {
+		return
+	}
+	record, err := encodeWALRecord(op, id, value, lat, long)
+	if err == nil {
+		_, err = a.wal.w.Write(record)
+	}
+	if err != nil {
+		a.wal.err = fmt.Errorf("write wal record for %s: %w", id, err)
+	}
+}
+
+// encodeWALRecord encodes a record including its length prefix. Remove records only contain the id.
+func encodeWALRecord[T any](op walOp, id string, value T, lat float64, long float64) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 4, 64))
+	buf.WriteByte(byte(op))
+	buf.Write(binary.AppendUvarint(nil, uint64(len(id))))
+	buf.WriteString(id)
+	if op != walRemove {
+		buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(lat)))
+		buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(long)))
+		if err := gob.NewEncoder(buf).Encode(&value); err != nil {
+			return nil, err
+		}
+	}
+	record := buf.Bytes()
+	binary.BigEndian.PutUint32(record, uint32(len(record)-4))
+	return record, nil
+}
+
+// ReplayWAL creates a new index with the given precision and applies all records of the write-ahead log in order.
+// A truncated record at the end of the log, as left by a crash during a write, is ignored.
+// The function returns an error if a record is corrupt, longer than 64 MiB, or the log can't be read.
+func ReplayWAL[T any](r io.Reader, precision int) (*KNN[T], error) {
+	knn, err := NewKNN[T](precision)
+	if err != nil {
+		return nil, err
+	}
+	var length [4]byte
+	for index := 0; ; index++ {
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return knn, nil
+			}
+			return nil, fmt.Errorf("read wal record %d: %w", index, err)
+		}
+		size := binary.BigEndian.Uint32(length[:])
+		if size > maxWALRecordSize {
+			return nil, fmt.Errorf("wal record %d: length %d exceeds the maximum of %d bytes", index, size, maxWALRecordSize)
+		}
+		record := make([]byte, size)
+		if _, err := io.ReadFull(r, record); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return knn, nil
+			}
+			return nil, fmt.Errorf("read wal record %d: %w", index, err)
+		}
+		if err := knn.applyWALRecord(record); err != nil {
+			return nil, fmt.Errorf("wal record %d: %w", index, err)
+		}
+	}
+}
+
+// applyWALRecord decodes a record without its length prefix and applies it to the index.
+// The replayed index has no write-ahead log, so the record is not appended again.
+func (a *KNN[T]) applyWALRecord(record []byte) error {
+	if len(record) == 0 {
+		return errors.New("empty record")
+	}
+	op, record := walOp(record[0]), record[1:]
+	idLength, n := binary.Uvarint(record)
+	if n <= 0 || uint64(len(record)-n) < idLength {
+		return errors.New("invalid id")
+	}
+	id, record := string(record[n:n+int(idLength)]), record[n+int(idLength):]
+	if op == walRemove {
+		a.removeValue(id)
+		return nil
+	}
+	if op != walAdd && op != walUpsert {
+		return fmt.Errorf("unknown operation %d", op)
+	}
+	if len(record) < 16 {
+		return errors.New("invalid coordinates")
+	}
+	lat := math.Float64frombits(binary.BigEndian.Uint64(record))
+	long := math.Float64frombits(binary.BigEndian.Uint64(record[8:]))
+	if err := validateCoordinates(lat, long); err != nil {
+		return err
+	}
+	var value T
+	if err := gob.NewDecoder(bytes.NewReader(record[16:])).Decode(&value); err != nil {
+		return fmt.Errorf("decode value: %w", err)
+	}
+	if op == walAdd {
+		a.addValue(id, value, lat, long)
+	} else {
+		a.upsertValue(id, value, lat, long)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package go_sknn
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type walPayload struct {
+	Name  string
+	Score float64
+}
+
+func Test_ReplayWAL(t *testing.T) {
+	var log bytes.Buffer
+	index, err := NewKNN[walPayload](14, WithWAL[walPayload](&log))
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	for i := range 1_000 {
+		index.AddValue(strconv.Itoa(i), walPayload{Name: "value-" + strconv.Itoa(i), Score: float64(i)}, RandLat(r), RandLong(r))
+	}
+	for i := range 100 {
+		assert.True(t, index.RemoveValue(strconv.Itoa(i)))
+	}
+	// Removing an unknown id is not logged.
+	assert.False(t, index.RemoveValue("unknown"))
+	for i := 100; i < 200; i++ {
+		index.UpsertValue(strconv.Itoa(i), walPayload{Name: "moved"}, RandLat(r), RandLong(r))
+	}
+	index.UpsertValue("new", walPayload{Name: "new"}, 1, 1)
+	assert.NoError(t, index.WALError())
+
+	replayed, err := ReplayWAL[walPayload](bytes.NewReader(log.Bytes()), 14)
+	assert.NoError(t, err)
+	assert.Equal(t, index.Fingerprint(), replayed.Fingerprint())
+	assert.Equal(t, len(index.lookup), len(replayed.lookup))
+	for id := range index.lookup {
+		expected, actual := index.findValue(id), replayed.findValue(id)
+		assert.Equal(t, expected.Value(), actual.Value())
+		assert.Equal(t, expected.CellID(), actual.CellID())
+	}
+
+	// A truncated last record is ignored.
+	truncated, err := ReplayWAL[walPayload](bytes.NewReader(log.Bytes()[:log.Len()-3]), 14)
+	assert.NoError(t, err)
+	assert.Len(t, truncated.lookup, len(index.lookup)-1)
+	assert.False(t, truncated.HasValue("new"))
+
+	// A corrupt record is an error.
+	corrupt := bytes.Clone(log.Bytes())
+	corrupt[4] = 42
+	_, err = ReplayWAL[walPayload](bytes.NewReader(corrupt), 14)
+	assert.ErrorContains(t, err, "wal record 0: unknown operation 42")
+
+	// A record longer than the maximum is rejected without allocating it.
+	_, err = ReplayWAL[walPayload](bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 1}), 14)
+	assert.ErrorContains(t, err, "wal record 0: length 4294967295 exceeds the maximum")
+
+	_, err = ReplayWAL[walPayload](bytes.NewReader(nil), 31)
+	assert.Error(t, err)
+}
+
+// slowWriter is a writer which sleeps before every write, so concurrent writers queue up for the log.
+type slowWriter struct {
+	bytes.Buffer
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(10 * time.Microsecond)
+	return w.Buffer.Write(p)
+}
+
+func Test_ReplayWAL_ConcurrentWrites(t *testing.T) {
+	var log slowWriter
+	index, err := NewKNN[int](14, WithWAL[int](&log))
+	assert.NoError(t, err)
+
+	// Writers change the same ids concurrently, the log must apply the changes in the same order as the index.
+	var wg sync.WaitGroup
+	for writer := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(writer)))
+			for i := range 250 {
+				id := strconv.Itoa(i % 5)
+				switch i % 6 {
+				case 0:
+					index.RemoveValue(id)
+				case 1:
+					index.PopValue(id)
+				case 2:
+					index.SwapValue(id, writer, RandLat(r), RandLong(r))
+				case 3:
+					index.AddValues([]Item[int]{{ID: id, Value: writer, Lat: RandLat(r), Long: RandLong(r)}})
+				default:
+					index.UpsertValue(id, writer, RandLat(r), RandLong(r))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.NoError(t, index.WALError())
+
+	replayed, err := ReplayWAL[int](bytes.NewReader(log.Bytes()), 14)
+	assert.NoError(t, err)
+	assert.Equal(t, index.Len(), replayed.Len())
+	for id := range 5 {
+		expected, actual := index.findValue(strconv.Itoa(id)), replayed.findValue(strconv.Itoa(id))
+		assert.Equal(t, expected == nil, actual == nil)
+		if expected != nil && actual != nil {
+			assert.Equal(t, expected.Value(), actual.Value())
+			assert.Equal(t, expected.CellID(), actual.CellID())
+		}
+	}
+}
+
+func Test_ReplayWAL_BuildConcurrent(t *testing.T) {
+	items := randomItems(1_000)
+	// Only the last item of a duplicate id is indexed and logged.
+	items = append(items, Item[int]{ID: "0", Value: -1, Lat: 10, Long: 10})
+	var log bytes.Buffer
+	index, err := BuildConcurrent(14, items, 2, WithWAL[int](&log))
+	assert.NoError(t, err)
+	var parallelLog bytes.Buffer
+	parallel, err := NewKNN[int](14, WithWAL[int](&parallelLog))
+	assert.NoError(t, err)
+	parallel.BuildParallel(items, 2)
+	assert.Equal(t, log.Bytes(), parallelLog.Bytes())
+
+	replayed, err := ReplayWAL[int](bytes.NewReader(log.Bytes()), 14)
+	assert.NoError(t, err)
+	assert.Equal(t, 1_000, replayed.Len())
+	for id := range index.lookup {
+		expected, actual := index.findValue(id), replayed.findValue(id)
+		assert.Equal(t, expected.Value(), actual.Value())
+		assert.Equal(t, expected.CellID(), actual.CellID())
+	}
+	value, _ := replayed.GetValue("0")
+	assert.Equal(t, -1, value)
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func Test_KNN_WALError(t *testing.T) {
+	index, err := NewKNN[int](14, WithWAL[int](failingWriter{}))
+	assert.NoError(t, err)
+	index.AddValue("1", 1, 1, 1)
+	// The index is still updated.
+	assert.True(t, index.HasValue("1"))
+	assert.EqualError(t, index.WALError(), "write wal record for 1: disk full")
+
+	index, err = NewKNN[int](14)
+	assert.NoError(t, err)
+	index.AddValue("1", 1, 1, 1)
+	assert.NoError(t, index.WALError())
+}